@@ -1,12 +1,9 @@
 package bridge
 
 import (
-	"bytes"
 	"errors"
-	"io/ioutil"
 	"log"
 	"net"
-	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -14,22 +11,80 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"text/template"
 	"time"
 
-	jsonp "github.com/buger/jsonparser"
 	dockerapi "github.com/fsouza/go-dockerclient"
 )
 
-var serviceIDPattern = regexp.MustCompile(`^(.+?):([a-zA-Z0-9][a-zA-Z0-9_.-]+):[0-9]+(?::udp)?$`)
+var serviceIDPattern = regexp.MustCompile(`^(.+?):([a-zA-Z0-9][a-zA-Z0-9_.-]+):([0-9]+)(?::(udp|sctp))?(?::([a-zA-Z0-9_.-]+))?$`)
 
+// serviceID is the decomposition of an ID generated by newService:
+// <hostname>:<container-name>:<exposed-port>[:<protocol>][:<alias>]
+type serviceID struct {
+	Hostname      string
+	ContainerName string
+	ExposedPort   string
+	PortType      string
+	Alias         string
+}
+
+func parseServiceID(id string) (serviceID, bool) {
+	matches := serviceIDPattern.FindStringSubmatch(id)
+	if len(matches) != 6 {
+		return serviceID{}, false
+	}
+	portType := matches[4]
+	if portType == "" {
+		portType = "tcp"
+	}
+	return serviceID{
+		Hostname:      matches[1],
+		ContainerName: matches[2],
+		ExposedPort:   matches[3],
+		PortType:      portType,
+		Alias:         matches[5],
+	}, true
+}
+
+// dockerClient is the part of the Docker API the bridge uses.
+type dockerClient interface {
+	InspectContainer(id string) (*dockerapi.Container, error)
+	ListContainers(opts dockerapi.ListContainersOptions) ([]dockerapi.APIContainers, error)
+}
+
+// Bridge keeps the registry in line with the containers of the host. Its
+// lock guards its state, and the services it tracks are only changed while
+// holding both it and the lock of their container. Where a service is in its
+// lifecycle is only known from its state; draining holds the timers of drains
+// in progress, and stopped, exits and health what Docker reported about the
+// containers, which the deregistration policy and health checks go by.
 type Bridge struct {
 	sync.Mutex
-	registry       RegistryAdapter
-	docker         *dockerapi.Client
-	services       map[string][]*Service
-	deadContainers map[string]*DeadContainer
-	config         Config
+	containers containerLocks
+	registry   RegistryAdapter
+	docker     dockerClient
+	services   map[string][]*Service
+	discovered map[string]string
+	draining   map[string]*time.Timer
+	stopped    map[string]bool
+	flaps      map[string]*flapState
+	exits      map[string][]time.Time
+	health     map[string]string
+	orphans    map[string]bool
+	policy     deregisterPolicy
+	limit      cleanupLimit
+	cleanedUp  *CleanupReport
+	foreign    map[string]string
+	conflicts  ConflictReport
+	sources    map[string]*dataSource
+	config     Config
+	instance   string
+
+	conflictPolicy string
+
+	hostMaintenance      MaintenanceMode
+	containerMaintenance map[string]MaintenanceMode
+	serviceMaintenance   map[string]MaintenanceMode
 }
 
 func New(docker *dockerapi.Client, adapterUri string, config Config) (*Bridge, error) {
@@ -42,13 +97,41 @@ func New(docker *dockerapi.Client, adapterUri string, config Config) (*Bridge, e
 		return nil, errors.New("unrecognized adapter: " + adapterUri)
 	}
 
+	policy, err := parseDeregisterPolicy(config.DeregisterCheck)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := parseCleanupLimit(config.CleanupMax)
+	if err != nil {
+		return nil, err
+	}
+	conflictPolicy, err := parseConflictPolicy(config.ConflictPolicy)
+	if err != nil {
+		return nil, err
+	}
+
 	log.Println("Using", uri.Scheme, "adapter:", uri)
 	return &Bridge{
-		docker:         docker,
-		config:         config,
-		registry:       factory.New(uri),
-		services:       make(map[string][]*Service),
-		deadContainers: make(map[string]*DeadContainer),
+		docker:     docker,
+		config:     config,
+		registry:   factory.New(uri),
+		services:   make(map[string][]*Service),
+		discovered: make(map[string]string),
+		draining:   make(map[string]*time.Timer),
+		stopped:    make(map[string]bool),
+		flaps:      make(map[string]*flapState),
+		exits:      make(map[string][]time.Time),
+		health:     make(map[string]string),
+		orphans:    make(map[string]bool),
+		policy:     policy,
+		limit:      limit,
+		sources:    newDataSources(config),
+		instance:   newInstanceID(),
+
+		conflictPolicy: conflictPolicy,
+
+		containerMaintenance: make(map[string]MaintenanceMode),
+		serviceMaintenance:   make(map[string]MaintenanceMode),
 	}, nil
 }
 
@@ -57,8 +140,16 @@ func (b *Bridge) Ping() error {
 }
 
 func (b *Bridge) Add(containerId string) {
+	unlock := b.containers.lock(containerId)
+	defer unlock()
+
 	b.Lock()
-	defer b.Unlock()
+	dampened := b.dampen(containerId)
+	b.Unlock()
+	if dampened {
+		b.removeServices(containerId, true)
+		return
+	}
 	b.add(containerId, false)
 }
 
@@ -66,37 +157,87 @@ func (b *Bridge) Remove(containerId string) {
 	b.remove(containerId, true)
 }
 
-func (b *Bridge) RemoveOnExit(containerId string) {
-	b.remove(containerId, b.shouldRemove(containerId))
-}
+// Destroy deregisters the failed services of a container that was removed.
+// They are kept for the container to restart, which it no longer can. Dead
+// services are left to their TTL, as with a container that only exited.
+func (b *Bridge) Destroy(containerId string) {
+	unlock := b.containers.lock(containerId)
+	defer unlock()
 
-func (b *Bridge) Refresh() {
 	b.Lock()
-	defer b.Unlock()
-
-	for containerId, deadContainer := range b.deadContainers {
-		deadContainer.TTL -= b.config.RefreshInterval
-		if deadContainer.TTL <= 0 {
-			delete(b.deadContainers, containerId)
+	var failed, kept []*Service
+	for _, service := range b.services[containerId] {
+		if service.State() == StateFailed {
+			failed = append(failed, service)
+		} else {
+			kept = append(kept, service)
 		}
 	}
+	if failed == nil {
+		b.Unlock()
+		return
+	}
+	if kept == nil {
+		b.forgetMaintenance(containerId, failed)
+		delete(b.exits, containerId)
+		delete(b.stopped, containerId)
+		delete(b.health, containerId)
+		delete(b.services, containerId)
+	} else {
+		b.services[containerId] = kept
+	}
+	b.Unlock()
 
-	for containerId, services := range b.services {
-		for _, service := range services {
-			err := b.registry.Refresh(service)
-			if err != nil {
-				log.Println("refresh failed:", service.ID, err)
-				continue
-			}
-			log.Println("refreshed:", containerId[:12], service.ID)
-		}
+	b.deregisterAll(containerId, failed, "container removed")
+}
+
+func (b *Bridge) RemoveOnExit(containerId string) {
+	unlock := b.containers.lock(containerId)
+	defer unlock()
+
+	b.Lock()
+	exits := append(b.exits[containerId], time.Now())
+	if len(exits) > maxExits {
+		exits = exits[len(exits)-maxExits:]
 	}
+	b.exits[containerId] = exits
+	b.Unlock()
+
+	if b.drain(containerId) {
+		return
+	}
+	b.exit(containerId)
 }
 
-func (b *Bridge) Sync(quiet bool) {
+// Drain takes the services of a container that is being stopped out of
+// rotation, ahead of its exit.
+func (b *Bridge) Drain(containerId string) {
+	unlock := b.containers.lock(containerId)
+	defer unlock()
+
+	b.Lock()
+	b.stopped[containerId] = true
+	b.Unlock()
+	b.drain(containerId)
+}
+
+// containerIds returns the containers with tracked services.
+func (b *Bridge) containerIds() []string {
 	b.Lock()
 	defer b.Unlock()
+	ids := make([]string, 0, len(b.services))
+	for containerId := range b.services {
+		ids = append(ids, containerId)
+	}
+	return ids
+}
 
+// Sync registers the services of running containers that aren't known yet,
+// and brings the registry in line with the known services: missing services
+// are registered, changed ones registered again, and with -cleanup, extra ones
+// registered from this host deregistered. Services the registry already has
+// as they are aren't written.
+func (b *Bridge) Sync(quiet bool) {
 	containers, err := b.docker.ListContainers(dockerapi.ListContainersOptions{})
 	if err != nil && quiet {
 		log.Println("error listing containers, skipping sync")
@@ -107,103 +248,274 @@ func (b *Bridge) Sync(quiet bool) {
 
 	log.Printf("Syncing services on %d containers", len(containers))
 
-	// NOTE: This assumes reregistering will do the right thing, i.e. nothing..
+	var known, unknown []string
+	b.Lock()
 	for _, listing := range containers {
-		services := b.services[listing.ID]
-		if services == nil {
-			b.add(listing.ID, quiet)
+		if b.live(listing.ID) {
+			known = append(known, listing.ID)
 		} else {
-			for _, service := range services {
-				err := b.registry.Register(service)
-				if err != nil {
-					log.Println("sync register failed:", service, err)
-				}
-			}
+			unknown = append(unknown, listing.ID)
 		}
 	}
+	b.Unlock()
+	parallel(unknown, registryConcurrency, func(containerId string) {
+		unlock, ok := b.containers.tryLock(containerId)
+		if !ok {
+			// being added right now
+			return
+		}
+		defer unlock()
+		b.add(containerId, quiet)
+	})
+
+	extServices, err := b.registry.Services()
+	complete := err == nil
+	if !complete {
+		// without the state of the registry, register everything again
+		log.Println("listing registered services failed:", err)
+	}
+	registered := make(map[string]*Service, len(extServices))
+	foreign := make(map[string]string)
+	for _, extService := range extServices {
+		registered[extService.ID] = extService
+		if owner := extService.Owner; owner != nil && owner.Node != b.nodeID() {
+			foreign[extService.ID] = owner.Node
+		}
+	}
+	if complete {
+		b.Lock()
+		b.foreign = foreign
+		b.Unlock()
+	}
+
+	var mu sync.Mutex
+	var total syncCounts
+	parallel(known, registryConcurrency, func(containerId string) {
+		counts := b.syncContainer(containerId, registered)
+		mu.Lock()
+		total.missing += counts.missing
+		total.changed += counts.changed
+		total.unchanged += counts.unchanged
+		total.failed += counts.failed
+		total.conflicting += counts.conflicting
+		mu.Unlock()
+	})
 
 	// Clean up services that were registered previously, but aren't
 	// acknowledged within registrator
-	if b.config.Cleanup {
-		// Remove services if its corresponding container is not running
-		log.Println("Listing non-exited containers")
-		filters := map[string][]string{"status": {"created", "restarting", "running", "paused"}}
-		nonExitedContainers, err := b.docker.ListContainers(dockerapi.ListContainersOptions{Filters: filters})
-		if err != nil {
-			log.Println("error listing nonExitedContainers, skipping sync", err)
-			return
+	extra := 0
+	if b.config.Cleanup || b.config.CleanupDryRun {
+		extra = b.cleanup(extServices, complete)
+	}
+	log.Printf("Synced services: %d missing, %d changed, %d extra, %d unchanged, %d failed, %d conflicting",
+		total.missing, total.changed, extra, total.unchanged, total.failed, total.conflicting)
+}
+
+// syncCounts counts the services of a sync by outcome.
+type syncCounts struct {
+	missing, changed, unchanged, failed, conflicting int
+}
+
+// syncContainer registers the services of a container that are missing from
+// the registry, or registered differently. A container busy with another
+// operation is left alone, as that operation writes its services anyway.
+func (b *Bridge) syncContainer(containerId string, registered map[string]*Service) syncCounts {
+	var counts syncCounts
+	unlock, ok := b.containers.tryLock(containerId)
+	if !ok {
+		log.Println("sync skipped:", containerId[:12], "busy")
+		return counts
+	}
+	defer unlock()
+
+	b.Lock()
+	services := append([]*Service{}, b.services[containerId]...)
+	b.Unlock()
+
+	for _, service := range services {
+		switch service.State() {
+		case StatePending:
+			// registering it failed before, or it conflicts
+			counts.missing++
+			b.retry(containerId, service, &counts)
+			continue
+		case StateRegistered, StateDraining:
+		default:
+			continue
 		}
-		for listingId := range b.services {
-			found := false
-			for _, container := range nonExitedContainers {
-				if listingId == container.ID {
-					found = true
-					break
-				}
-			}
-			// This is a container that does not exist
-			if !found {
-				log.Printf("stale: Removing service %s because it does not exist", listingId)
-				go b.RemoveOnExit(listingId)
-			}
+		extService, ok := registered[service.ID]
+		switch {
+		case ok && extService.Owner != nil && extService.Owner.Node != b.nodeID():
+			// overwritten by another host
+			counts.changed++
+			b.displacedBy(containerId, service, extService.Owner.Node)
+			b.retry(containerId, service, &counts)
+			continue
+		case !ok:
+			counts.missing++
+		case !sameService(service, extService):
+			counts.changed++
+		default:
+			counts.unchanged++
+			continue
 		}
-
-		log.Println("Cleaning up dangling services")
-		extServices, err := b.registry.Services()
+		err := b.registry.Register(service)
 		if err != nil {
-			log.Println("cleanup failed:", err)
-			return
+			log.Println("sync register failed:", service, err)
+			counts.failed++
 		}
+	}
+	return counts
+}
 
-	Outer:
-		for _, extService := range extServices {
-			matches := serviceIDPattern.FindStringSubmatch(extService.ID)
-			if len(matches) != 3 {
-				// There's no way this was registered by us, so leave it
-				continue
-			}
-			serviceHostname := matches[1]
-			if serviceHostname != Hostname {
-				// ignore because registered on a different host
-				continue
-			}
-			serviceContainerName := matches[2]
-			for _, listing := range b.services {
-				for _, service := range listing {
-					if service.Name == extService.Name && serviceContainerName == service.Origin.container.Name[1:] {
-						continue Outer
-					}
-				}
-			}
-			log.Println("dangling:", extService.ID)
-			err := b.registry.Deregister(extService)
-			if err != nil {
-				log.Println("deregister failed:", extService.ID, err)
-				continue
+// retry writes a pending service again, and counts whether it failed or
+// still conflicts with another service.
+func (b *Bridge) retry(containerId string, service *Service, counts *syncCounts) {
+	if b.write(containerId, service) {
+		return
+	}
+	b.Lock()
+	conflicting := service.conflict != "" && service.State() == StatePending
+	b.Unlock()
+	if conflicting {
+		counts.conflicting++
+	} else {
+		counts.failed++
+	}
+}
+
+// tracked reports whether a service is tracked. IDs carry the exposed port
+// and protocol, so a UDP service doesn't keep a stale TCP one alive. Dead and
+// failed services kept for exited containers are tracked too.
+func (b *Bridge) tracked(serviceId string) bool {
+	b.Lock()
+	defer b.Unlock()
+	for _, services := range b.services {
+		for _, service := range services {
+			if service.ID == serviceId {
+				return true
 			}
-			log.Println(extService.ID, "removed")
 		}
 	}
+	return false
 }
 
-func (b *Bridge) add(containerId string, quiet bool) {
-	if d := b.deadContainers[containerId]; d != nil {
-		b.services[containerId] = d.Services
-		delete(b.deadContainers, containerId)
+// trackedIDs returns the IDs of the tracked services, for looking up many of
+// them at once. It is called with the bridge lock held.
+func (b *Bridge) trackedIDs() map[string]bool {
+	ids := make(map[string]bool)
+	for _, services := range b.services {
+		for _, service := range services {
+			ids[service.ID] = true
+		}
 	}
+	return ids
+}
 
-	if b.services[containerId] != nil {
-		log.Println("container, ", containerId[:12], ", already exists, ignoring")
-		// Alternatively, remove and readd or resubmit.
+// add registers the services of a container. The caller holds its lock, as
+// for the other container operations below.
+func (b *Bridge) add(containerId string, quiet bool) {
+	b.Lock()
+	suppressed := b.suppressed(containerId)
+	b.Unlock()
+	if suppressed {
 		return
 	}
-
 	container, err := b.docker.InspectContainer(containerId)
 	if err != nil {
 		log.Println("unable to inspect container:", containerId[:12], err)
 		return
 	}
+	if !container.State.Running {
+		// exited before it was seen, e.g. a start handled after its die
+		log.Println("container not running, skipping:", containerId[:12])
+		return
+	}
+	b.addContainer(container, quiet)
+}
 
+// addContainer registers the services of an inspected container, or updates
+// them if it is known already.
+func (b *Bridge) addContainer(container *dockerapi.Container, quiet bool) {
+	containerId := container.ID
+	b.Lock()
+	if b.suppressed(containerId) {
+		b.Unlock()
+		return
+	}
+	delete(b.stopped, containerId)
+	b.Unlock()
+
+	b.restore(containerId)
+
+	b.Lock()
+	known := b.services[containerId] != nil
+	b.Unlock()
+	if known {
+		// The container restarted while its services were kept, and may have
+		// come back with another IP or randomly assigned host port
+		log.Println("container, ", containerId[:12], ", already exists, updating")
+		b.reconcile(container)
+		return
+	}
+
+	health, _ := containerHealth(container)
+	b.Lock()
+	b.setContainerHealth(containerId, health)
+	b.Unlock()
+	for _, service := range b.containerServices(container, quiet) {
+		b.register(container.ID, service)
+	}
+}
+
+// register tracks a new service of a container, and writes it to the
+// registry.
+func (b *Bridge) register(containerId string, service *Service) bool {
+	b.Lock()
+	service.transition(StatePending, "discovered")
+	b.services[containerId] = append(b.services[containerId], service)
+	b.Unlock()
+	return b.write(containerId, service)
+}
+
+// write registers a pending service. It stays pending if that fails, or it
+// conflicts with another service, for the next sync to retry.
+func (b *Bridge) write(containerId string, service *Service) bool {
+	if !b.claim(containerId, service) {
+		return false
+	}
+	b.Lock()
+	if service.Attrs == nil {
+		service.Attrs = make(map[string]string)
+	}
+	b.applyMaintenance(containerId, service)
+	service.Owner = b.owner(containerId)
+	service.transition(StateRegistering, "")
+	b.Unlock()
+
+	err := b.registry.Register(service)
+
+	b.Lock()
+	if err != nil {
+		service.transition(StatePending, "register failed: "+err.Error())
+	} else {
+		service.transition(StateRegistered, "")
+	}
+	b.Unlock()
+	if err != nil {
+		log.Println("register failed:", service, err)
+		return false
+	}
+	if service.Status() != "" {
+		b.updateStatus(service)
+	}
+	log.Println("added:", containerId[:12], service.ID)
+	return true
+}
+
+// containerServices derives the services of a container from its ports and
+// metadata.
+func (b *Bridge) containerServices(container *dockerapi.Container, quiet bool) []*Service {
 	ports := make(map[string]ServicePort)
 
 	// Extract configured host port mappings, relevant when using --net=host
@@ -217,9 +529,35 @@ func (b *Bridge) add(containerId string, quiet bool) {
 		ports[string(port)] = servicePort(container, port, published)
 	}
 
-	if len(ports) == 0 && !quiet {
-		log.Println("ignored:", container.ID[:12], "no published ports")
-		return
+	// Discover listening sockets, relevant when using --net=host without EXPOSE
+	if b.config.DiscoverHostPorts && container.HostConfig.NetworkMode == "host" {
+		discovered := b.discoverPorts(container)
+		for _, port := range discovered {
+			if _, ok := ports[string(port)]; !ok {
+				published := []dockerapi.PortBinding{{HostIP: "0.0.0.0", HostPort: port.Port()}}
+				ports[string(port)] = servicePort(container, port, published)
+			}
+		}
+		b.Lock()
+		b.discovered[container.ID] = portList(discovered)
+		b.Unlock()
+	}
+
+	specs, err := parseServiceSpecs(container.Config.Labels[ServicesLabel])
+	if err != nil {
+		log.Println("ignored label:", container.ID[:12], err)
+	}
+
+	if len(ports) == 0 {
+		// Workers and consumers that don't listen are registered on port 0
+		// when they are given a name
+		if b.hasServiceName(container, specs) {
+			published := []dockerapi.PortBinding{{HostIP: "0.0.0.0", HostPort: portlessPort}}
+			ports[portlessPort+"/tcp"] = servicePort(container, dockerapi.Port(portlessPort+"/tcp"), published)
+		} else if !quiet {
+			log.Println("ignored:", container.ID[:12], "no published ports")
+			return nil
+		}
 	}
 
 	servicePorts := make(map[string]ServicePort)
@@ -234,35 +572,193 @@ func (b *Bridge) add(containerId string, quiet bool) {
 	}
 
 	isGroup := len(servicePorts) > 1
+	if isGroup {
+		if services := b.groupedService(container, servicePorts, specs); services != nil {
+			return services
+		}
+	}
+
+	var services []*Service
 	for _, port := range servicePorts {
-		service := b.newService(port, isGroup)
-		if service == nil {
+		s := b.newService(port, isGroup, specs)
+		if s == nil {
 			if !quiet {
 				log.Println("ignored:", container.ID[:12], "service on port", port.ExposedPort)
 			}
 			continue
 		}
-		err := b.registry.Register(service)
-		if err != nil {
-			log.Println("register failed:", service, err)
+		services = append(services, s...)
+	}
+	return services
+}
+
+// Update derives the services of a running container again, after it was
+// connected to or disconnected from a network, and updates those whose
+// endpoint or metadata changed in the registry.
+func (b *Bridge) Update(containerId string) {
+	unlock := b.containers.lock(containerId)
+	defer unlock()
+
+	container, err := b.docker.InspectContainer(containerId)
+	if err != nil {
+		log.Println("unable to inspect container:", containerId[:12], err)
+		return
+	}
+	if !container.State.Running {
+		// containers are disconnected from their networks when they stop
+		return
+	}
+	b.Lock()
+	live := b.live(containerId)
+	b.Unlock()
+	if !live {
+		b.add(containerId, true)
+		return
+	}
+	b.reconcile(container)
+}
+
+// reconcile replaces the services of a known container with the ones derived
+// from it now. Unchanged services are left alone, changed ones deregistered
+// and registered again, and the ones that are gone deregistered.
+func (b *Bridge) reconcile(container *dockerapi.Container) {
+	services := b.containerServices(container, true)
+
+	previous := make(map[string]*Service)
+	b.Lock()
+	for _, service := range b.services[container.ID] {
+		previous[service.requested()] = service
+	}
+	b.Unlock()
+
+	var kept []*Service
+	var added []*Service
+	draining := make(map[*Service]bool)
+	for _, service := range services {
+		old := previous[service.ID]
+		if old == nil {
+			added = append(added, service)
 			continue
 		}
-		b.services[container.ID] = append(b.services[container.ID], service)
-		log.Println("added:", container.ID[:12], service.ID)
+		delete(previous, service.ID)
+		// a change of health alone is written by updateHealth below
+		for _, attr := range append([]string{HealthAttr}, StatusAttrs...) {
+			if v := old.Attrs[attr]; v != "" {
+				service.Attrs[attr] = v
+			}
+		}
+		if sameService(service, old) && samePorts(service.Ports, old.Ports) {
+			kept = append(kept, old)
+			continue
+		}
+		log.Println("changed:", container.ID[:12], service.ID)
+		b.deregisterAll(container.ID, []*Service{old}, "changed")
+		if old.State() == StateDraining {
+			draining[service] = true
+		}
+		added = append(added, service)
 	}
+
+	var gone []*Service
+	for _, service := range previous {
+		gone = append(gone, service)
+	}
+	b.deregisterAll(container.ID, gone, "gone")
+
+	b.Lock()
+	b.services[container.ID] = kept
+	b.Unlock()
+	for _, service := range added {
+		if b.register(container.ID, service) && draining[service] {
+			b.Lock()
+			service.transition(StateDraining, "draining")
+			b.Unlock()
+			b.updateStatus(service)
+		}
+	}
+	b.updateHealth(container)
+}
+
+// groupedService registers all ports of a container as a single service when
+// SERVICE_PRIMARY_PORT selects its main port. The other ports are stored in
+// Service.Ports under the name given by SERVICE_<port>_PORTNAME, or their
+// exposed port. It returns nil when the container doesn't opt in.
+func (b *Bridge) groupedService(container *dockerapi.Container, servicePorts map[string]ServicePort, specs []serviceSpec) []*Service {
+	metadata, _ := serviceMetaData(container.Config, "", b.config.MetadataPrefixes)
+	primaryPort := mapDefault(metadata, "primary_port", "")
+	if primaryPort == "" {
+		return nil
+	}
+	primary, ok := servicePorts[primaryPort]
+	if !ok && !strings.Contains(primaryPort, "/") {
+		primary, ok = servicePorts[primaryPort+"/tcp"]
+	}
+	if !ok {
+		log.Println("primary port", primaryPort, "not published by", container.ID[:12]+", registering ports separately")
+		return nil
+	}
+
+	services := b.newService(primary, false, specs)
+	if services == nil {
+		return nil
+	}
+	ports := make(map[string]NamedPort)
+	for _, port := range servicePorts {
+		named := services[0]
+		if port != primary {
+			s := b.newService(port, false, specs)
+			if s == nil {
+				continue
+			}
+			named = s[0]
+		}
+		portMetadata, _ := serviceMetaData(container.Config, port.ExposedPort+"/"+port.PortType, b.config.MetadataPrefixes)
+		name := mapDefault(portMetadata, "portname", port.ExposedPort)
+		if !portNamePattern.MatchString(name) {
+			log.Printf("ignored port name %q of %s: only letters, digits, '_' and '-' are allowed", name, container.ID[:12])
+			name = port.ExposedPort
+		}
+		if _, exists := ports[name]; exists {
+			name += "-" + port.PortType
+		}
+		ports[name] = NamedPort{Port: named.Port, Protocol: port.PortType}
+	}
+	for _, service := range services {
+		service.Ports = ports
+	}
+	return services
 }
 
-func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
+// portlessPort is the exposed port of the service of a container without
+// ports. No real port is 0, so its ID can't collide with another service.
+const portlessPort = "0"
+
+// hasServiceName reports whether a name is set for the container as a whole,
+// by SERVICE_NAME or an entry of the services label without a port.
+func (b *Bridge) hasServiceName(container *dockerapi.Container, specs []serviceSpec) bool {
+	metadata, _ := serviceMetaData(container.Config, "", b.config.MetadataPrefixes)
+	if mapDefault(metadata, "name", "") != "" {
+		return true
+	}
+	for _, spec := range specs {
+		if spec.port == "" && spec.Name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+var portNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// newService returns the services for port, the primary service followed by
+// its aliases, or nil if the port is ignored.
+func (b *Bridge) newService(port ServicePort, isgroup bool, specs []serviceSpec) []*Service {
 	container := port.container
 	defaultName := strings.Split(path.Base(container.Config.Image), ":")[0]
 
 	// not sure about this logic. kind of want to remove it.
-	hostname := Hostname
-	if hostname == "" {
-		hostname = port.HostIP
-	}
-	if port.HostIP == "0.0.0.0" {
-		ip, err := net.ResolveIPAddr("ip", hostname)
+	if port.HostIP == "0.0.0.0" && Hostname != "" {
+		ip, err := net.ResolveIPAddr("ip", Hostname)
 		if err == nil {
 			port.HostIP = ip.String()
 		}
@@ -272,7 +768,8 @@ func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
 		port.HostIP = b.config.HostIp
 	}
 
-	metadata, metadataFromPort := serviceMetaData(container.Config, port.ExposedPort)
+	metadata, metadataFromPort := serviceMetaData(container.Config, port.ExposedPort+"/"+port.PortType, b.config.MetadataPrefixes)
+	specTags := mergeServiceSpecs(specs, port, metadata, metadataFromPort)
 
 	ignore := mapDefault(metadata, "ignore", "")
 	if ignore != "" {
@@ -289,7 +786,7 @@ func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
 
 	service := new(Service)
 	service.Origin = port
-	service.ID = hostname + ":" + container.Name[1:] + ":" + port.ExposedPort
+	service.ID = b.nodeID() + ":" + container.Name[1:] + ":" + port.ExposedPort
 	service.Name = serviceName
 	if isgroup && !metadataFromPort["name"] {
 		service.Name += "-" + port.ExposedPort
@@ -338,400 +835,482 @@ func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
 		}
 	}
 
-	// Use container inspect data to populate tags list
-	// https://github.com/fsouza/go-dockerclient/blob/master/container.go#L441-L483
-	ForceTags := b.config.ForceTags
-	if len(ForceTags) != 0 {
-		// Template functions
-		fm := template.FuncMap{
-			// Template function name: strSlice
-			// Description: Slice string from start to end (same as s[start:end] where s represents string).
-			//
-			// Usage: strSlice s start end
-			//
-			// Example: strSlice .ID 0 12
-			// {
-			//     "Id": "e20f9c1a76565d62ae24a3bb877b17b862b6eab94f4e95a0e07ccf25087aaf4f"
-			// }
-			// Output: "e20f9c1a7656"
-			//
-			"strSlice": func(v string, i ...int) string {
-				if len(i) == 1 {
-					if len(v) >= i[0] {
-						return v[i[0]:]
-					}
-				}
-
-				if len(i) == 2 {
-					if len(v) >= i[0] && len(v) >= i[1] {
-						if i[0] == 0 {
-							return v[:i[1]]
-						}
-						if i[1] < i[0] {
-							return v[i[0]:]
-						}
-						return v[i[0]:i[1]]
-					}
-				}
-
-				return v
-			},
-			// Template function name: sIndex
-			// Description: Return element from slice or array s by specifiying index i (same as s[i] where s represents slice or array - index i can also take negative values to extract elements in reverse order).
-			//
-			// Usage: sIndex i s
-			//
-			// Example: sIndex 0 .Config.Env
-			// {
-			//     "Config": {
-			//         "Env": [
-			//             "ENVIRONMENT=test",
-			//             "SERVICE_8105_NAME=foo",
-			//             "HOME=/home/foobar",
-			//             "SERVICE_9404_NAME=bar"
-			//         ]
-			//     }
-			// }
-			// Output: "ENVIRONMENT=test"
-			//
-			"sIndex": func(i int, s []string) string {
-				if i < 0 {
-					i = i * -1
-					if i >= len(s) {
-						return s[0]
-					}
-					return s[len(s)-i]
-				}
-
-				if i >= len(s) {
-					return s[len(s)-1]
-				}
-
-				return s[i]
-			},
-			// Template function name: mIndex
-			// Description: Return value for key k stored in the map m (same as m["k"]).
-			//
-			// Usage: mIndex k m
-			//
-			// Example: mIndex "com.amazonaws.ecs.task-arn" .Config.Labels
-			// {
-			//     "Config": {
-			//         "Labels": {
-			//             "com.amazonaws.ecs.task-arn": "arn:aws:ecs:region:xxxxxxxxxxxx:task/368f4403-0ee4-4f4c-b7a5-be50c57db5cf"
-			//         }
-			//     }
-			// }
-			// Output: "arn:aws:ecs:region:xxxxxxxxxxxx:task/368f4403-0ee4-4f4c-b7a5-be50c57db5cf"
-			//
-			"mIndex": func(k string, m map[string]string) string {
-				return m[k]
-			},
-			// Template function name: toUpper
-			// Description: Return s with all letters mapped to their upper case.
-			//
-			// Usage: toUpper s
-			//
-			// Example: toUpper "foo"
-			// Output: "FOO"
-			//
-			"toUpper": func(v string) string {
-				return strings.ToUpper(v)
-			},
-			// Template function name: toLower
-			// Description: Return s with all letters mapped to their lower case.
-			//
-			// Usage: toLower s
-			//
-			// Example: toLower "FoO"
-			// Output: "foo"
-			//
-			"toLower": func(v string) string {
-				return strings.ToLower(v)
-			},
-			// Template function name: replace
-			// Description: Replace all (-1) or first n occurrences of "old" with "new" found in the designated string s.
-			//
-			// Usage: replace n old new s
-			//
-			// Example: replace -1 "=" "" "=foo="
-			// Output: "foo"
-			//
-			"replace": func(n int, old, new, v string) string {
-				return strings.Replace(v, old, new, n)
-			},
-			// Template function name: join
-			// Description: Create a single string from all the elements found in the slice s where sep will be used as separator.
-			//
-			// Usage: join sep s
-			//
-			// Example: join "," .Config.Env
-			// {
-			//     "Config": {
-			//         "Env": [
-			//             "ENVIRONMENT=test",
-			//             "SERVICE_8105_NAME=foo",
-			//             "HOME=/home/foobar",
-			//             "SERVICE_9404_NAME=bar"
-			//         ]
-			//     }
-			// }
-			// Output: "ENVIRONMENT=test,SERVICE_8105_NAME=foo,HOME=/home/foobar,SERVICE_9404_NAME=bar"
-			//
-			"join": func(sep string, s []string) string {
-				return strings.Join(s, sep)
-			},
-			// Template function name: split
-			// Description: Split string s into all substrings separated by sep and return a slice of the substrings between those separators.
-			//
-			// Usage: split sep s
-			//
-			// Example: split "," "/proc/bus,/proc/fs,/proc/irq"
-			// Output: [/proc/bus /proc/fs /proc/irq]
-			//
-			"split": func(sep, v string) []string {
-				return strings.Split(v, sep)
-			},
-			// Template function name: splitIndex
-			// Description: split and sIndex function combined, index i can also take negative values to extract elements in reverse order.
-			//				Same result can be achieved if using pipeline with both functions: {{ split sep s | sIndex i }}
-			//
-			// Usage: splitIndex i sep s
-			//
-			// Example: splitIndex -1 "/" "arn:aws:ecs:region:xxxxxxxxxxxx:task/368f4403-0ee4-4f4c-b7a5-be50c57db5cf"
-			// Output: "368f4403-0ee4-4f4c-b7a5-be50c57db5cf"
-			//
-			"splitIndex": func(i int, sep, v string) string {
-				l := strings.Split(v, sep)
-
-				if i < 0 {
-					i = i * -1
-					if i >= len(l) {
-						return l[0]
-					}
-					return l[len(l)-i]
-				}
-
-				if i >= len(l) {
-					return l[len(l)-1]
-				}
-
-				return l[i]
-			},
-			// Template function name: matchFirstElement
-			// Description: Iterate through slice s and return first element that match regex expression.
-			//
-			// Usage: matchFirstElement regex s
-			//
-			// Example: matchFirstElement "^SERVICE_" .Config.Env
-			// {
-			//     "Config": {
-			//         "Env": [
-			//             "ENVIRONMENT=test",
-			//             "SERVICE_8105_NAME=foo",
-			//             "HOME=/home/foobar",
-			//             "SERVICE_9404_NAME=bar"
-			//         ]
-			//     }
-			// }
-			// Output: "SERVICE_8105_NAME=foo"
-			//
-			"matchFirstElement": func(r string, s []string) string {
-				var m string
-
-				re := regexp.MustCompile(r)
-				for _, e := range s {
-					if re.MatchString(e) {
-						m = e
-						break
-					}
-				}
-
-				return m
-			},
-			// Template function name: matchAllElements
-			// Description: Iterate through slice s and return slice of all elements that match regex expression.
-			//
-			// Usage: matchAllElements regex s
-			//
-			// Example: matchAllElements "^SERVICE_" .Config.Env
-			// {
-			//     "Config": {
-			//         "Env": [
-			//             "ENVIRONMENT=test",
-			//             "SERVICE_8105_NAME=foo",
-			//             "HOME=/home/foobar",
-			//             "SERVICE_9404_NAME=bar"
-			//         ]
-			//     }
-			// }
-			// Output: [SERVICE_8105_NAME=foo SERVICE_9404_NAME=bar]
-			//
-			"matchAllElements": func(r string, s []string) []string {
-				var m []string
-
-				re := regexp.MustCompile(r)
-				for _, e := range s {
-					if re.MatchString(e) {
-						m = append(m, e)
-					}
-				}
-
-				return m
-			},
-			// Template function name: httpGet
-			// Description: Fetch an object from URL.
-			//
-			// Usage: httpGet url
-			//
-			// Example: httpGet "https://ajpi.me/all"
-			// Output: []byte (e.g. JSON object)
-			//
-			"httpGet": func(url string) []byte {
-				// HTTP client configuration
-				c := &http.Client{
-					Timeout: 10 * time.Second,
-				}
-
-				res, err := c.Get(url)
-				if err != nil {
-					log.Printf("httpGet template function encountered an error while executing HTTP request: %v", err)
-					return []byte("")
-				}
-
-				body, err := ioutil.ReadAll(res.Body)
-				res.Body.Close()
-				if err != nil {
-					log.Printf("httpGet template function encountered an error while reading HTTP body payload: %v", err)
-					return []byte("")
-				}
-
-				return body
-			},
-			// Template function name: jsonParse
-			// Description: Extract value from JSON object by specifying exact path (nested objects). Keys in path has to be separated with double colon sign.
-			//
-			// Usage: jsonParse b key1::key2::key3::keyN
-			//
-			// Example: jsonParse b "Additional::Country"
-			// {
-			//     "Additional": {
-			//         "Country": "United States"
-			//     }
-			// }
-			// Output: "United States"
-			//
-			"jsonParse": func(b []byte, k string) string {
-				var (
-					keys []string
-					js   []byte
-					err  error
-				)
-
-				keys = strings.Split(k, "::")
-
-				js, _, _, err = jsonp.Get(b, keys...)
-				if err != nil {
-					log.Printf("jsonParse template function encountered an error while parsing JSON object %v: %v", keys, err)
-				}
-
-				return string(js)
-			},
-		}
-
-		tmpl, err := template.New("tags").Funcs(fm).Parse(ForceTags)
+	// Remember the endpoint derived from the binding before any override, so
+	// health checks keep targeting what the container actually listens on
+	service.Origin.IP = service.IP
+	service.Origin.Port = service.Port
+
+	if address := mapDefault(metadata, "address", ""); address != "" {
+		address, err := b.renderTemplate("address", address, container)
 		if err != nil {
-			log.Fatalf("%s template parsing failed with error: %s", ForceTags, err)
+			log.Println("ignored address override:", container.ID[:12], err)
+		} else if address != "" {
+			service.IP = address
+		}
+	}
+	if advertised := mapDefault(metadata, "port", ""); advertised != "" {
+		advertised, err := b.renderTemplate("port", advertised, container)
+		p, perr := strconv.Atoi(strings.TrimSpace(advertised))
+		if err == nil && (perr != nil || p < 1 || p > 65535) {
+			err = errors.New("invalid port " + strconv.Quote(advertised))
 		}
-
-		var b bytes.Buffer
-		err = tmpl.Execute(&b, container)
 		if err != nil {
-			log.Fatalf("%s template execution failed with error: %s", ForceTags, err)
+			log.Println("ignored port override:", container.ID[:12], err)
+		} else {
+			service.Port = p
 		}
+	}
+	delete(metadata, "address")
+	delete(metadata, "deregister")
+	delete(metadata, "drain")
+	delete(metadata, "maintenance")
+	delete(metadata, "port")
+	delete(metadata, "portname")
+	ttl := mapDefault(metadata, "ttl", "")
+	delete(metadata, "primary_port")
+	delete(metadata, "ttl")
 
-		ForceTags = b.String()
+	// Use container inspect data to populate tags list
+	// https://github.com/fsouza/go-dockerclient/blob/master/container.go#L441-L483
+	ForceTags, err := b.renderTemplate("tags", b.config.ForceTags, container)
+	if err != nil {
+		log.Fatalf("%s template failed with error: %s", b.config.ForceTags, err)
 	}
 
-	if port.PortType == "udp" {
+	if port.PortType != "tcp" {
 		service.Tags = combineTags(
-			mapDefault(metadata, "tags", ""), ForceTags, "udp")
-		service.ID = service.ID + ":udp"
+			mapDefault(metadata, "tags", ""), ForceTags, port.PortType)
+		service.ID = service.ID + ":" + port.PortType
 	} else {
 		service.Tags = combineTags(
 			mapDefault(metadata, "tags", ""), ForceTags)
 	}
+	if specTags != nil {
+		service.Tags = append(append([]string{}, specTags...), service.Tags...)
+	}
 
 	id := mapDefault(metadata, "id", "")
 	if id != "" {
 		service.ID = id
 	}
 
+	aliases := serviceAliases(metadata)
+
 	delete(metadata, "id")
 	delete(metadata, "tags")
 	delete(metadata, "name")
 	service.Attrs = metadata
+	health, output := containerHealth(container)
+	setHealth(service, health, output)
 	service.TTL = b.config.RefreshTtl
+	if ttl != "" {
+		seconds, err := b.serviceTTL(ttl)
+		if err != nil {
+			log.Println("ignored ttl:", container.ID[:12], err)
+		} else {
+			service.TTL = seconds
+		}
+	}
 
-	return service
+	services := []*Service{service}
+	for _, alias := range aliases {
+		a := *service
+		a.ID = service.ID + ":" + alias.name
+		a.Name = alias.name
+		a.Tags = append([]string{}, service.Tags...)
+		if alias.tags != "" {
+			a.Tags = combineTags(alias.tags, ForceTags)
+			if port.PortType != "tcp" {
+				a.Tags = append(a.Tags, port.PortType)
+			}
+		}
+		a.Attrs = make(map[string]string, len(service.Attrs))
+		for k, v := range service.Attrs {
+			a.Attrs[k] = v
+		}
+		services = append(services, &a)
+	}
+	return services
 }
 
 func (b *Bridge) remove(containerId string, deregister bool) {
-	b.Lock()
-	defer b.Unlock()
+	unlock := b.containers.lock(containerId)
+	defer unlock()
+	b.removeServices(containerId, deregister)
+}
 
+// removeServices deregisters the services of a container, or when deregister
+// is false, marks them dead: they stay registered, and tracked until their TTL
+// expired, without being refreshed.
+func (b *Bridge) removeServices(containerId string, deregister bool) {
+	b.Lock()
+	services := b.services[containerId]
 	if deregister {
-		deregisterAll := func(services []*Service) {
-			for _, service := range services {
-				err := b.registry.Deregister(service)
-				if err != nil {
-					log.Println("deregister failed:", service.ID, err)
-					continue
-				}
-				log.Println("removed:", containerId[:12], service.ID)
+		b.forgetMaintenance(containerId, services)
+		delete(b.exits, containerId)
+		delete(b.stopped, containerId)
+		delete(b.health, containerId)
+		delete(b.services, containerId)
+	} else {
+		// services without a TTL don't expire, they are left for -cleanup
+		var dead []*Service
+		for _, service := range b.exited(containerId, StateDead, "exited") {
+			if service.TTL > 0 {
+				dead = append(dead, service)
 			}
 		}
-		deregisterAll(b.services[containerId])
-		if d := b.deadContainers[containerId]; d != nil {
-			deregisterAll(d.Services)
-			delete(b.deadContainers, containerId)
+		if dead == nil {
+			delete(b.services, containerId)
+		} else {
+			b.services[containerId] = dead
+		}
+	}
+	delete(b.discovered, containerId)
+	if timer, ok := b.draining[containerId]; ok {
+		timer.Stop()
+	}
+	delete(b.draining, containerId)
+	b.Unlock()
+
+	if deregister {
+		b.deregisterAll(containerId, services, "removed")
+	}
+}
+
+// drain marks the services of a container as draining, and deregisters them
+// when the drain period has passed. It reports whether the container is
+// draining, in which case it is up to the drain to remove its services.
+func (b *Bridge) drain(containerId string) bool {
+	b.Lock()
+	var services []*Service
+	for _, service := range b.services[containerId] {
+		switch service.State() {
+		case StateDraining:
+			// draining, or drained and the container has now exited
+			_, ok := b.draining[containerId]
+			b.Unlock()
+			return ok
+		case StateRegistered:
+			services = append(services, service)
+		}
+	}
+	period := b.drainPeriod(services)
+	if len(services) == 0 || period <= 0 {
+		b.Unlock()
+		return false
+	}
+
+	log.Println("draining:", containerId[:12], "for", period)
+	for _, service := range services {
+		service.transition(StateDraining, "draining for "+period.String())
+	}
+	b.draining[containerId] = time.AfterFunc(period, func() {
+		b.endDrain(containerId)
+	})
+	b.Unlock()
+
+	for _, service := range services {
+		b.updateStatus(service)
+	}
+	return true
+}
+
+// endDrain deregisters the services of a drained container once it exited.
+// A container still shutting down stays drained until it exits.
+func (b *Bridge) endDrain(containerId string) {
+	unlock := b.containers.lock(containerId)
+	defer unlock()
+
+	container, err := b.docker.InspectContainer(containerId)
+	running := err == nil && container.State.Running
+
+	b.Lock()
+	delete(b.draining, containerId)
+	if !b.isDraining(containerId) {
+		// restored or removed in the meantime
+		b.Unlock()
+		return
+	}
+	if running {
+		// its services stay draining, without a timer, until it exits
+		log.Println("drained:", containerId[:12], "still running, deregistering on exit")
+		b.Unlock()
+		return
+	}
+	b.Unlock()
+
+	b.exit(containerId)
+}
+
+// restore puts the services of a container that came back while draining, or
+// after exiting, back into rotation.
+func (b *Bridge) restore(containerId string) {
+	var restored []*Service
+	b.Lock()
+	if timer, ok := b.draining[containerId]; ok {
+		timer.Stop()
+	}
+	delete(b.draining, containerId)
+
+	for _, service := range b.services[containerId] {
+		switch service.State() {
+		case StateDraining, StateFailed, StateDead:
+		default:
+			continue
+		}
+		unavailable := service.Attrs["draining"] != "" || service.Attrs["failing"] != ""
+		service.transition(StateRegistered, "container started")
+		if unavailable {
+			restored = append(restored, service)
 		}
-	} else if b.config.RefreshTtl != 0 && b.services[containerId] != nil {
-		// need to stop the refreshing, but can't delete it yet
-		b.deadContainers[containerId] = &DeadContainer{b.config.RefreshTtl, b.services[containerId]}
 	}
-	delete(b.services, containerId)
+	b.Unlock()
+
+	for _, service := range restored {
+		log.Println("restored:", containerId[:12], service.ID)
+		b.updateStatus(service)
+	}
+}
+
+func (b *Bridge) updateStatus(service *Service) {
+	err := b.registry.UpdateStatus(service)
+	if err != nil {
+		log.Println("status update failed:", service.ID, err)
+	}
+}
+
+// drainPeriod returns how long the services of a container are drained
+// before they are deregistered: SERVICE_DRAIN, or the global -drain.
+func (b *Bridge) drainPeriod(services []*Service) time.Duration {
+	period := time.Duration(b.config.DrainPeriod) * time.Second
+	if len(services) == 0 || services[0].Origin.container == nil {
+		return period
+	}
+	metadata, _ := serviceMetaData(services[0].Origin.container.Config, "", b.config.MetadataPrefixes)
+	if drain := mapDefault(metadata, "drain", ""); drain != "" {
+		d, err := parseDuration(drain)
+		if err != nil {
+			log.Println("ignored drain period:", services[0].Origin.ContainerID[:12], err)
+			return period
+		}
+		return d
+	}
+	return period
+}
+
+// parseDuration accepts a number of seconds or a Go duration like "1m30s".
+func parseDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// deregisterAll removes services from the registry, those that were written
+// to it, and moves them to the deregistered state.
+func (b *Bridge) deregisterAll(containerId string, services []*Service, reason string) {
+	for _, service := range services {
+		b.Lock()
+		held := b.heldByOther(containerId, service)
+		b.Unlock()
+		var err error
+		if service.inRegistry() && held {
+			log.Println("not deregistering:", service.ID, "registered by another container")
+		} else if service.inRegistry() {
+			err = b.registry.Deregister(service)
+		}
+		b.Lock()
+		if err != nil {
+			service.transition(StateDeregistered, reason+", deregister failed: "+err.Error())
+		} else {
+			service.transition(StateDeregistered, reason)
+		}
+		b.Unlock()
+		if err != nil {
+			log.Println("deregister failed:", service.ID, err)
+			continue
+		}
+		log.Println("removed:", containerId[:12], service.ID)
+	}
+}
+
+// Rescan looks for ports that host network containers started or stopped
+// listening on since they were added, and updates their services if anything
+// changed.
+func (b *Bridge) Rescan() {
+	b.Lock()
+	discovered := make(map[string]string, len(b.discovered))
+	for containerId, ports := range b.discovered {
+		discovered[containerId] = ports
+	}
+	b.Unlock()
+
+	for containerId, ports := range discovered {
+		b.rescan(containerId, ports)
+	}
+}
+
+func (b *Bridge) rescan(containerId, ports string) {
+	unlock := b.containers.lock(containerId)
+	defer unlock()
+
+	container, err := b.docker.InspectContainer(containerId)
+	if err != nil || !container.State.Running {
+		b.Lock()
+		delete(b.discovered, containerId)
+		b.Unlock()
+		return
+	}
+	if portList(b.discoverPorts(container)) == ports {
+		return
+	}
+	log.Println("listening ports of", containerId[:12], "changed")
+	b.reconcile(container)
+}
+
+func (b *Bridge) discoverPorts(container *dockerapi.Container) []dockerapi.Port {
+	procPath := b.config.ProcPath
+	if procPath == "" {
+		procPath = "/proc"
+	}
+	ports, err := listeningPorts(procPath, container.State.Pid)
+	if err != nil {
+		log.Println("unable to discover listening ports:", container.ID[:12], err)
+	}
+	return ports
+}
+
+func portList(ports []dockerapi.Port) string {
+	list := make([]string, len(ports))
+	for i, port := range ports {
+		list[i] = string(port)
+	}
+	return strings.Join(list, ",")
 }
 
 // bit set on ExitCode if it represents an exit via a signal
 var dockerSignaledBit = 128
 
-func (b *Bridge) shouldRemove(containerId string) bool {
-	if b.config.DeregisterCheck == "always" {
-		return true
+// exit applies the deregistration policy to the services of an exited
+// container.
+func (b *Bridge) exit(containerId string) {
+	outcome, reason := b.exitOutcome(containerId)
+	switch outcome {
+	case OutcomeDeregister:
+		b.removeServices(containerId, true)
+	case OutcomeFail:
+		b.fail(containerId, reason)
+	default:
+		b.removeServices(containerId, false)
+	}
+}
+
+// exitOutcome decides what happens to the services of an exited container,
+// per its SERVICE_DEREGISTER policy or the global -deregister one. The reason
+// describes the exit.
+func (b *Bridge) exitOutcome(containerId string) (string, string) {
+	b.Lock()
+	policy := b.containerPolicy(containerId)
+	exit := exitInfo{
+		stopped: b.stopped[containerId],
+		exits:   b.exits[containerId],
+		now:     time.Now(),
 	}
+	b.Unlock()
+
 	container, err := b.docker.InspectContainer(containerId)
 	if _, ok := err.(*dockerapi.NoSuchContainer); ok {
 		// the container has already been removed from Docker
 		// e.g. probabably run with "--rm" to remove immediately
 		// so its exit code is not accessible
 		log.Printf("registrator: container %v was removed, could not fetch exit code", containerId[:12])
-		return true
+		return OutcomeDeregister, "removed"
 	}
 
 	switch {
 	case err != nil:
 		log.Printf("registrator: error fetching status for container %v on \"die\" event: %v\n", containerId[:12], err)
-		return false
+		if outcome, ok := policy.unconditional(); ok {
+			return outcome, "unknown exit"
+		}
+		return OutcomeKeep, "unknown exit"
 	case container.State.Running:
 		log.Printf("registrator: not removing container %v, still running", containerId[:12])
-		return false
-	case container.State.ExitCode == 0:
-		return true
-	case container.State.ExitCode&dockerSignaledBit == dockerSignaledBit:
-		return true
+		return OutcomeKeep, "running"
 	}
-	return false
+
+	exit.container = container
+	reason := "exit code " + strconv.Itoa(container.State.ExitCode)
+	if container.State.OOMKilled {
+		reason = "out of memory"
+	}
+	outcome, rule := policy.decide(exit)
+	log.Printf("registrator: container %v exited (%s), %s services by rule %s", containerId[:12], reason, outcomeVerb(outcome), rule)
+	return outcome, reason
+}
+
+// containerPolicy returns the SERVICE_DEREGISTER policy of a container, or
+// the global one.
+func (b *Bridge) containerPolicy(containerId string) deregisterPolicy {
+	services := b.services[containerId]
+	if len(services) == 0 || services[0].Origin.container == nil {
+		return b.policy
+	}
+	metadata, _ := serviceMetaData(services[0].Origin.container.Config, "", b.config.MetadataPrefixes)
+	text := mapDefault(metadata, "deregister", "")
+	if text == "" {
+		return b.policy
+	}
+	policy, err := parseDeregisterPolicy(text)
+	if err != nil {
+		log.Println("ignored deregister policy:", containerId[:12], err)
+		return b.policy
+	}
+	return policy
+}
+
+// fail marks the services of an exited container as failing, and keeps them
+// registered until the container comes back.
+func (b *Bridge) fail(containerId string, reason string) {
+	b.Lock()
+	failed := b.exited(containerId, StateFailed, reason)
+	if failed == nil {
+		delete(b.services, containerId)
+	} else {
+		b.services[containerId] = failed
+	}
+	delete(b.discovered, containerId)
+	b.Unlock()
+
+	for _, service := range failed {
+		b.updateStatus(service)
+	}
+}
+
+// exited moves the services of an exited container that are in the registry
+// to state, and returns them. Those that never made it into the registry are
+// dropped.
+func (b *Bridge) exited(containerId string, state State, reason string) []*Service {
+	var kept []*Service
+	for _, service := range b.services[containerId] {
+		if !service.inRegistry() {
+			service.transition(StateDeregistered, "exited before registration")
+			continue
+		}
+		service.transition(state, reason)
+		kept = append(kept, service)
+	}
+	return kept
+}
+
+func outcomeVerb(outcome string) string {
+	switch outcome {
+	case OutcomeKeep:
+		return "keeping"
+	case OutcomeFail:
+		return "failing"
+	}
+	return "deregistering"
 }
 
 var Hostname string
@@ -1,8 +1,11 @@
 package bridge
 
 import (
+	"strconv"
 	"testing"
+	"time"
 
+	dockerapi "github.com/fsouza/go-dockerclient"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,3 +24,335 @@ func TestNewValid(t *testing.T) {
 	assert.NotNil(t, bridge)
 	assert.NoError(t, err)
 }
+
+func testContainer(env []string, ports ...dockerapi.Port) *dockerapi.Container {
+	container := &dockerapi.Container{
+		ID:   "0123456789abcdef0123456789abcdef",
+		Name: "/web.0",
+		Config: &dockerapi.Config{
+			Image:        "acme/web:1.0",
+			Env:          env,
+			ExposedPorts: make(map[dockerapi.Port]struct{}),
+		},
+		HostConfig: &dockerapi.HostConfig{NetworkMode: "bridge"},
+		NetworkSettings: &dockerapi.NetworkSettings{
+			IPAddress: "172.17.0.2",
+			Ports:     make(map[dockerapi.Port][]dockerapi.PortBinding),
+		},
+	}
+	for i, port := range ports {
+		container.NetworkSettings.Ports[port] = []dockerapi.PortBinding{
+			{HostIP: "0.0.0.0", HostPort: strconv.Itoa(32768 + i)},
+		}
+	}
+	return container
+}
+
+func testBridge(t *testing.T, config Config) *Bridge {
+	Register(new(fakeFactory), "fake")
+	if config.HostIp == "" {
+		config.HostIp = "10.0.0.1"
+	}
+	b, err := New(nil, "fake://", config)
+	assert.NoError(t, err)
+	return b
+}
+
+func TestNewServiceAddressOverride(t *testing.T) {
+	b := testBridge(t, Config{})
+	container := testContainer([]string{
+		"SERVICE_ADDRESS={{ .Config.Hostname }}.proxy.internal",
+		"SERVICE_80_PORT=443",
+	}, "80/tcp")
+	container.Config.Hostname = "web"
+
+	port := servicePort(container, "80/tcp", container.NetworkSettings.Ports["80/tcp"])
+	services := b.newService(port, false, nil)
+
+	assert.Len(t, services, 1)
+	assert.Equal(t, "web.proxy.internal", services[0].IP)
+	assert.Equal(t, 443, services[0].Port)
+	assert.Equal(t, "10.0.0.1", services[0].Origin.IP)
+	assert.Equal(t, 32768, services[0].Origin.Port)
+	assert.Empty(t, services[0].Attrs)
+}
+
+func TestNewServiceInvalidPortOverride(t *testing.T) {
+	b := testBridge(t, Config{})
+	container := testContainer([]string{"SERVICE_PORT=http"}, "80/tcp")
+
+	port := servicePort(container, "80/tcp", container.NetworkSettings.Ports["80/tcp"])
+	services := b.newService(port, false, nil)
+
+	assert.Equal(t, "10.0.0.1", services[0].IP)
+	assert.Equal(t, 32768, services[0].Port)
+}
+
+func TestGroupedService(t *testing.T) {
+	b := testBridge(t, Config{})
+	container := testContainer([]string{
+		"SERVICE_NAME=api",
+		"SERVICE_PRIMARY_PORT=8080",
+		"SERVICE_9090_PORTNAME=metrics",
+	}, "8080/tcp", "9090/tcp")
+
+	ports := make(map[string]ServicePort)
+	for port, published := range container.NetworkSettings.Ports {
+		ports[string(port)] = servicePort(container, port, published)
+	}
+	services := b.groupedService(container, ports, nil)
+
+	assert.Len(t, services, 1)
+	assert.Equal(t, "api", services[0].Name)
+	assert.Equal(t, 32768, services[0].Port)
+	assert.Equal(t, map[string]NamedPort{
+		"8080":    {Port: 32768, Protocol: "tcp"},
+		"metrics": {Port: 32769, Protocol: "tcp"},
+	}, services[0].Ports)
+	assert.Empty(t, services[0].Attrs)
+
+	container.Config.Env = []string{"SERVICE_NAME=api"}
+	assert.Nil(t, b.groupedService(container, ports, nil))
+}
+
+func TestParseServiceID(t *testing.T) {
+	cases := []struct {
+		ID       string
+		Expected serviceID
+		Ok       bool
+	}{
+		{"host:web.0:80", serviceID{"host", "web.0", "80", "tcp", ""}, true},
+		{"host:dns:53:udp", serviceID{"host", "dns", "53", "udp", ""}, true},
+		{"host:sig:2905:sctp", serviceID{"host", "sig", "2905", "sctp", ""}, true},
+		{"host:web.0:80:legacy", serviceID{"host", "web.0", "80", "tcp", "legacy"}, true},
+		{"host:dns:53:udp:resolver", serviceID{"host", "dns", "53", "udp", "resolver"}, true},
+		{"custom-id", serviceID{}, false},
+		{"host:web.0:http", serviceID{}, false},
+	}
+	for _, c := range cases {
+		id, ok := parseServiceID(c.ID)
+		assert.Equal(t, c.Ok, ok, c.ID)
+		assert.Equal(t, c.Expected, id, c.ID)
+	}
+}
+
+func TestNewServiceProtocols(t *testing.T) {
+	b := testBridge(t, Config{})
+	container := testContainer([]string{
+		"SERVICE_53_NAME=dns",
+		"SERVICE_53_UDP_NAME=dns-udp",
+	}, "53/tcp", "53/udp", "2905/sctp")
+
+	service := func(p dockerapi.Port) *Service {
+		port := servicePort(container, p, container.NetworkSettings.Ports[p])
+		return b.newService(port, true, nil)[0]
+	}
+
+	tcp, udp, sctp := service("53/tcp"), service("53/udp"), service("2905/sctp")
+	assert.Equal(t, Hostname+":web.0:53", tcp.ID)
+	assert.Equal(t, "dns", tcp.Name)
+	assert.Empty(t, tcp.Tags)
+	assert.Equal(t, Hostname+":web.0:53:udp", udp.ID)
+	assert.Equal(t, "dns-udp", udp.Name)
+	assert.Equal(t, []string{"udp"}, udp.Tags)
+	assert.Equal(t, Hostname+":web.0:2905:sctp", sctp.ID)
+	assert.Equal(t, "web-2905", sctp.Name)
+	assert.Equal(t, []string{"sctp"}, sctp.Tags)
+}
+
+func TestPortlessService(t *testing.T) {
+	b := testBridge(t, Config{})
+	published := []dockerapi.PortBinding{{HostIP: "0.0.0.0", HostPort: portlessPort}}
+
+	assert.False(t, b.hasServiceName(testContainer(nil), nil))
+	specs, err := parseServiceSpecs(`[{"name": "consumer"}]`)
+	assert.NoError(t, err)
+	assert.True(t, b.hasServiceName(testContainer(nil), specs))
+
+	container := testContainer([]string{"SERVICE_NAME=worker"})
+	assert.True(t, b.hasServiceName(container, nil))
+	services := b.newService(servicePort(container, "0/tcp", published), false, nil)
+	assert.Len(t, services, 1)
+	assert.Equal(t, "worker", services[0].Name)
+	assert.Equal(t, Hostname+":web.0:0", services[0].ID)
+	assert.Equal(t, 0, services[0].Port)
+	id, ok := parseServiceID(services[0].ID)
+	assert.True(t, ok)
+	assert.Equal(t, "0", id.ExposedPort)
+
+	container = testContainer([]string{"SERVICE_NAME=worker", "SERVICE_PORT=9100"})
+	services = b.newService(servicePort(container, "0/tcp", published), false, nil)
+	assert.Equal(t, 9100, services[0].Port)
+}
+
+// registeredBridge returns a bridge with the services of container's port 80
+// registered, and a registry recording the calls made to it.
+func registeredBridge(t *testing.T, container *dockerapi.Container) (*Bridge, *recordingAdapter) {
+	b := testBridge(t, Config{})
+	registry := new(recordingAdapter)
+	b.registry = registry
+	b.docker = &fakeDocker{containers: map[string]*dockerapi.Container{container.ID: container}}
+	port := servicePort(container, "80/tcp", container.NetworkSettings.Ports["80/tcp"])
+	b.services[container.ID] = markRegistered(b.newService(port, false, nil))
+	return b, registry
+}
+
+// markRegistered moves services to the registered state, as if the bridge
+// had registered them.
+func markRegistered(services []*Service) []*Service {
+	for _, service := range services {
+		service.transition(StatePending, "discovered")
+		service.transition(StateRegistering, "")
+		service.transition(StateRegistered, "")
+	}
+	return services
+}
+
+func TestDrain(t *testing.T) {
+	container := testContainer([]string{"SERVICE_DRAIN=20ms"}, "80/tcp")
+	b, registry := registeredBridge(t, container)
+	id := b.services[container.ID][0].ID
+	assert.NotContains(t, b.services[container.ID][0].Attrs, "drain")
+
+	b.RemoveOnExit(container.ID)
+	assert.Equal(t, []string{"status:draining " + id}, registry.Calls())
+
+	assert.Eventually(t, func() bool {
+		calls := registry.Calls()
+		return len(calls) == 2 && calls[1] == "deregister "+id
+	}, time.Second, 10*time.Millisecond)
+	b.Lock()
+	defer b.Unlock()
+	assert.Empty(t, b.services)
+	assert.Empty(t, b.draining)
+}
+
+func TestDrainRestore(t *testing.T) {
+	container := testContainer([]string{"SERVICE_DRAIN=20ms"}, "80/tcp")
+	container.State.Running = true
+	b, registry := registeredBridge(t, container)
+	id := b.services[container.ID][0].ID
+
+	b.Drain(container.ID)
+	b.Add(container.ID)
+	assert.Equal(t, []string{"status:draining " + id, "status: " + id}, registry.Calls())
+	assert.Equal(t, "", b.services[container.ID][0].Status())
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, registry.Calls(), 2)
+}
+
+func TestDrainUntilExit(t *testing.T) {
+	container := testContainer([]string{"SERVICE_DRAIN=1ms"}, "80/tcp")
+	container.State.Running = true
+	b, registry := registeredBridge(t, container)
+
+	b.Drain(container.ID)
+	assert.Eventually(t, func() bool {
+		b.Lock()
+		defer b.Unlock()
+		_, ok := b.draining[container.ID]
+		return !ok && b.isDraining(container.ID)
+	}, time.Second, 10*time.Millisecond)
+	assert.Len(t, registry.Calls(), 1)
+
+	container.State.Running = false
+	b.RemoveOnExit(container.ID)
+	assert.Len(t, registry.Calls(), 2)
+	assert.Empty(t, b.services)
+}
+
+func TestParseDuration(t *testing.T) {
+	d, err := parseDuration("30")
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, d)
+	d, err = parseDuration("1m30s")
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Second, d)
+	_, err = parseDuration("soon")
+	assert.Error(t, err)
+}
+
+func TestSyncWritesDifferences(t *testing.T) {
+	container := testContainer(nil, "80/tcp", "443/tcp")
+	container.State.Running = true
+	b, registry := registeredBridge(t, container)
+	b.config.Cleanup = true
+	port := servicePort(container, "443/tcp", container.NetworkSettings.Ports["443/tcp"])
+	b.services[container.ID] = append(b.services[container.ID], markRegistered(b.newService(port, false, nil))...)
+	web, secure := b.services[container.ID][0], b.services[container.ID][1]
+
+	changed := *secure
+	changed.Port = 1234
+	registry.registered = []*Service{
+		{ID: web.ID, Name: web.Name, IP: web.IP, Port: web.Port, Tags: web.Tags},
+		&changed,
+		{ID: Hostname + ":old.0:80", Name: "old", Owner: &Owner{Node: Hostname}},
+		{ID: "elsewhere:web.1:80", Name: "web", Owner: &Owner{Node: "elsewhere"}},
+		{ID: "consul", Name: "consul"},
+	}
+
+	b.Sync(true)
+	assert.Equal(t, []string{"register " + secure.ID}, registry.Calls())
+
+	// dangling services go once a second sync finds them
+	registry.registered[1] = secure
+	b.Sync(true)
+	assert.Equal(t, []string{
+		"register " + secure.ID,
+		"deregister " + Hostname + ":old.0:80",
+	}, registry.Calls())
+}
+
+func TestUpdateChangedAddress(t *testing.T) {
+	b := testBridge(t, Config{Internal: true})
+	registry := new(recordingAdapter)
+	b.registry = registry
+	container := testContainer(nil, "80/tcp")
+	container.State.Running = true
+	b.docker = &fakeDocker{containers: map[string]*dockerapi.Container{container.ID: container}}
+
+	b.Add(container.ID)
+	id := Hostname + ":web.0:80"
+	assert.Equal(t, []string{"register " + id}, registry.Calls())
+
+	b.Update(container.ID)
+	assert.Len(t, registry.Calls(), 1)
+
+	container.NetworkSettings.IPAddress = "172.18.0.5"
+	b.Update(container.ID)
+	assert.Equal(t, []string{"register " + id, "deregister " + id, "register " + id}, registry.Calls())
+	assert.Equal(t, "172.18.0.5", b.services[container.ID][0].IP)
+
+	container.State.Running = false
+	container.NetworkSettings.IPAddress = ""
+	b.Update(container.ID)
+	assert.Len(t, registry.Calls(), 3)
+}
+
+func TestRestartUpdatesChangedServices(t *testing.T) {
+	b := testBridge(t, Config{RefreshTtl: 60, RefreshInterval: 30})
+	registry := new(recordingAdapter)
+	b.registry = registry
+	container := testContainer(nil, "80/tcp", "443/tcp")
+	container.State.Running = true
+	b.docker = &fakeDocker{containers: map[string]*dockerapi.Container{container.ID: container}}
+
+	b.Add(container.ID)
+	assert.Len(t, registry.Calls(), 2)
+	b.remove(container.ID, false)
+	assert.Equal(t, StateDead, b.services[container.ID][0].State())
+
+	// comes back with a new host port for 443 only
+	container.NetworkSettings.Ports["443/tcp"] = []dockerapi.PortBinding{{HostIP: "0.0.0.0", HostPort: "40000"}}
+	b.Add(container.ID)
+	id := Hostname + ":web.0:443"
+	assert.Equal(t, []string{"deregister " + id, "register " + id}, registry.Calls()[2:])
+	assert.Len(t, b.services[container.ID], 2)
+	for _, service := range b.services[container.ID] {
+		assert.Equal(t, StateRegistered, service.State())
+		if service.ID == id {
+			assert.Equal(t, 40000, service.Port)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package bridge
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// cleanupLimit caps the dangling services a single sync deregisters, as a
+// number, or a percentage of the services registered from this host.
+type cleanupLimit struct {
+	count   int
+	percent int
+}
+
+// parseCleanupLimit parses -cleanup-max, e.g. "10" or "25%". An empty or
+// zero limit means no limit.
+func parseCleanupLimit(text string) (cleanupLimit, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return cleanupLimit{}, nil
+	}
+	percent := strings.HasSuffix(text, "%")
+	n, err := strconv.Atoi(strings.TrimSuffix(text, "%"))
+	if err != nil || n < 0 || (percent && n > 100) {
+		return cleanupLimit{}, errors.New("invalid cleanup limit " + strconv.Quote(text) + ", expected a number or a percentage")
+	}
+	if percent {
+		return cleanupLimit{percent: n}, nil
+	}
+	return cleanupLimit{count: n}, nil
+}
+
+// max returns how many of owned services may be deregistered, or -1 for no
+// limit. A percentage allows at least one.
+func (l cleanupLimit) max(owned int) int {
+	switch {
+	case l.count > 0:
+		return l.count
+	case l.percent > 0:
+		if n := owned * l.percent / 100; n > 0 {
+			return n
+		}
+		return 1
+	}
+	return -1
+}
+
+// CleanupReport describes what the last cleanup did with the dangling
+// services registered from this host.
+type CleanupReport struct {
+	Time   time.Time `json:"time"`
+	DryRun bool      `json:"dry_run"`
+	// Removed were deregistered, or would have been in a dry run
+	Removed []string `json:"removed"`
+	// Pending were seen for the first time, and are removed if they are
+	// still dangling on the next sync
+	Pending []string `json:"pending"`
+	// Deferred were left for the next sync by -cleanup-max
+	Deferred []string `json:"deferred"`
+	Failed   []string `json:"failed"`
+}
+
+// cleanup removes the services of containers that are gone, and, when
+// extServices is the complete list of registered services, deregisters those
+// registered from this host that are unknown. A dangling service is only
+// deregistered once it was seen in two consecutive syncs, and -cleanup-max
+// caps how many go at once, so that a hiccup doesn't wipe the host from the
+// registry. It returns the number of services deregistered.
+func (b *Bridge) cleanup(extServices []*Service, complete bool) int {
+	dryRun := b.config.CleanupDryRun
+
+	// Remove services if its corresponding container is not running
+	log.Println("Listing non-exited containers")
+	filters := map[string][]string{"status": {"created", "restarting", "running", "paused"}}
+	nonExitedContainers, err := b.docker.ListContainers(dockerapi.ListContainersOptions{Filters: filters})
+	if err != nil {
+		log.Println("error listing nonExitedContainers, skipping sync", err)
+		return 0
+	}
+	nonExited := make(map[string]bool, len(nonExitedContainers))
+	for _, container := range nonExitedContainers {
+		nonExited[container.ID] = true
+	}
+	var failed []string
+	b.Lock()
+	for listingId := range b.services {
+		// This is a container that does not exist
+		if b.live(listingId) && !nonExited[listingId] {
+			if dryRun {
+				log.Printf("stale: would remove services of %s because it does not exist (dry run)", listingId)
+				continue
+			}
+			log.Printf("stale: Removing service %s because it does not exist", listingId)
+			go b.RemoveOnExit(listingId)
+		} else if !b.live(listingId) && b.hasFailed(listingId) {
+			failed = append(failed, listingId)
+		}
+	}
+	b.Unlock()
+
+	// failed services are kept for a restart, unless the container is gone
+	for _, containerId := range failed {
+		if _, err := b.docker.InspectContainer(containerId); err == nil {
+			continue
+		} else if _, ok := err.(*dockerapi.NoSuchContainer); !ok {
+			continue
+		}
+		if dryRun {
+			log.Printf("stale: would remove failed services of %s because it does not exist (dry run)", containerId)
+			continue
+		}
+		log.Printf("stale: Removing failed services of %s because it does not exist", containerId)
+		b.Destroy(containerId)
+	}
+
+	if !complete {
+		log.Println("cleanup skipped, registered services unknown")
+		return 0
+	}
+	log.Println("Cleaning up dangling services")
+
+	b.Lock()
+	tracked := b.trackedIDs()
+	b.Unlock()
+	owned := 0
+	var dangling []*Service
+	for _, extService := range extServices {
+		if !b.owned(extService) {
+			// registered on a different host, or not by us at all
+			continue
+		}
+		owned++
+		if !tracked[extService.ID] {
+			dangling = append(dangling, extService)
+		}
+	}
+	sort.Slice(dangling, func(i, j int) bool {
+		return dangling[i].ID < dangling[j].ID
+	})
+
+	report := &CleanupReport{
+		Time:     time.Now(),
+		DryRun:   dryRun,
+		Removed:  []string{},
+		Pending:  []string{},
+		Deferred: []string{},
+		Failed:   []string{},
+	}
+	max := b.limit.max(owned)
+	b.Lock()
+	seen := b.orphans
+	b.orphans = make(map[string]bool, len(dangling))
+	for _, extService := range dangling {
+		b.orphans[extService.ID] = true
+	}
+	// services registered while the registry was listed
+	tracked = b.trackedIDs()
+	b.Unlock()
+
+	for _, extService := range dangling {
+		switch {
+		case !seen[extService.ID]:
+			log.Println("dangling:", extService.ID, "removing if still dangling on the next sync")
+			report.Pending = append(report.Pending, extService.ID)
+			continue
+		case max >= 0 && len(report.Removed) >= max:
+			report.Deferred = append(report.Deferred, extService.ID)
+			continue
+		case tracked[extService.ID]:
+			// registered in the meantime
+			continue
+		case dryRun:
+			log.Println("dangling:", extService.ID, "would be removed (dry run)")
+			report.Removed = append(report.Removed, extService.ID)
+			continue
+		}
+		log.Println("dangling:", extService.ID)
+		err := b.registry.Deregister(extService)
+		if err != nil {
+			log.Println("deregister failed:", extService.ID, err)
+			report.Failed = append(report.Failed, extService.ID)
+			continue
+		}
+		log.Println(extService.ID, "removed")
+		report.Removed = append(report.Removed, extService.ID)
+	}
+	if len(report.Deferred) > 0 {
+		log.Printf("cleanup limited to %d of %d services registered from this host, %d left for the next sync",
+			max, owned, len(report.Deferred))
+	}
+	verb := "removed"
+	if dryRun {
+		verb = "would remove"
+	}
+	log.Printf("Cleanup report: %s %d, %d pending, %d deferred, %d failed",
+		verb, len(report.Removed), len(report.Pending), len(report.Deferred), len(report.Failed))
+
+	b.Lock()
+	b.cleanedUp = report
+	b.Unlock()
+	if dryRun {
+		return 0
+	}
+	return len(report.Removed)
+}
+
+// Cleanup returns the report of the last cleanup, or nil if there was none.
+func (b *Bridge) Cleanup() *CleanupReport {
+	b.Lock()
+	defer b.Unlock()
+	return b.cleanedUp
+}
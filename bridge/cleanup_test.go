@@ -0,0 +1,97 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCleanupLimit(t *testing.T) {
+	for text, expected := range map[string]cleanupLimit{
+		"":    {},
+		"0":   {},
+		"10":  {count: 10},
+		"25%": {percent: 25},
+	} {
+		limit, err := parseCleanupLimit(text)
+		assert.NoError(t, err, text)
+		assert.Equal(t, expected, limit, text)
+	}
+	for _, text := range []string{"-1", "ten", "150%", "%"} {
+		_, err := parseCleanupLimit(text)
+		assert.Error(t, err, text)
+	}
+
+	assert.Equal(t, -1, cleanupLimit{}.max(10))
+	assert.Equal(t, 3, cleanupLimit{count: 3}.max(10))
+	assert.Equal(t, 5, cleanupLimit{percent: 50}.max(10))
+	assert.Equal(t, 1, cleanupLimit{percent: 10}.max(5))
+}
+
+// danglingBridge returns a bridge without containers, whose registry has n
+// services registered from this host.
+func danglingBridge(t *testing.T, config Config, n int) (*Bridge, *recordingAdapter) {
+	config.Cleanup = true
+	b := testBridge(t, config)
+	b.docker = &fakeDocker{containers: map[string]*dockerapi.Container{}}
+	registry := new(recordingAdapter)
+	for i := 0; i < n; i++ {
+		registry.registered = append(registry.registered,
+			&Service{ID: fmt.Sprintf("%s:web.%d:80", Hostname, i), Name: "web", Owner: &Owner{Node: Hostname}})
+	}
+	b.registry = registry
+	return b, registry
+}
+
+func TestCleanupLimit(t *testing.T) {
+	b, registry := danglingBridge(t, Config{CleanupMax: "50%"}, 4)
+
+	b.Sync(true)
+	assert.Empty(t, registry.Calls())
+	assert.Len(t, b.Cleanup().Pending, 4)
+
+	b.Sync(true)
+	assert.Equal(t, []string{
+		"deregister " + Hostname + ":web.0:80",
+		"deregister " + Hostname + ":web.1:80",
+	}, registry.Calls())
+	report := b.Cleanup()
+	assert.Len(t, report.Removed, 2)
+	assert.Equal(t, []string{Hostname + ":web.2:80", Hostname + ":web.3:80"}, report.Deferred)
+
+	// deferred services are still confirmed on the next sync, whose limit is
+	// half of the two services left
+	registry.registered = registry.registered[2:]
+	b.Sync(true)
+	assert.Len(t, registry.Calls(), 3)
+	registry.registered = registry.registered[1:]
+	b.Sync(true)
+	assert.Equal(t, "deregister "+Hostname+":web.3:80", registry.Calls()[3])
+}
+
+func TestCleanupForgetsServicesBack(t *testing.T) {
+	b, registry := danglingBridge(t, Config{}, 2)
+	b.Sync(true)
+
+	// one of them is tracked by the next sync
+	b.services["0123456789abcdef0123456789abcdef"] = markRegistered([]*Service{{ID: Hostname + ":web.0:80"}})
+	b.Sync(true)
+	assert.Equal(t, []string{"deregister " + Hostname + ":web.1:80"}, registry.Calls())
+}
+
+func TestCleanupDryRun(t *testing.T) {
+	b, registry := danglingBridge(t, Config{CleanupDryRun: true}, 2)
+	b.Sync(true)
+	b.Sync(true)
+	assert.Empty(t, registry.Calls())
+	report := b.Cleanup()
+	assert.True(t, report.DryRun)
+	assert.Len(t, report.Removed, 2)
+
+	encoded, err := json.Marshal(report)
+	assert.NoError(t, err)
+	assert.Contains(t, string(encoded), `"pending":[],"deferred":[],"failed":[]`)
+}
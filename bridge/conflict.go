@@ -0,0 +1,326 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policies for a service whose ID or endpoint is already registered by
+// another container, or whose ID is registered by another host.
+const (
+	// ConflictLastWriterWins registers the service, and the one it collides
+	// with waits until the service is gone.
+	ConflictLastWriterWins = "last-writer-wins"
+	// ConflictReject leaves the service pending until the one it collides
+	// with is gone.
+	ConflictReject = "reject"
+	// ConflictSuffix registers the service with a suffix appended to its ID,
+	// e.g. "web-2". Endpoint conflicts, which a new ID doesn't resolve, are
+	// rejected.
+	ConflictSuffix = "suffix"
+)
+
+// Kinds of conflicts.
+const (
+	conflictID   = "id"
+	conflictPort = "port"
+)
+
+// maxConflicts bounds the recent conflicts kept for the conflict report.
+const maxConflicts = 32
+
+// parseConflictPolicy parses -conflict-policy, which defaults to
+// last-writer-wins.
+func parseConflictPolicy(text string) (string, error) {
+	switch text = strings.TrimSpace(text); text {
+	case "":
+		return ConflictLastWriterWins, nil
+	case ConflictLastWriterWins, ConflictReject, ConflictSuffix:
+		return text, nil
+	}
+	return "", errors.New("invalid conflict policy " + strconv.Quote(text) + ", expected " +
+		ConflictLastWriterWins + ", " + ConflictReject + " or " + ConflictSuffix)
+}
+
+// Conflict describes a service that collided with another one.
+type Conflict struct {
+	Time time.Time `json:"time"`
+	// Kind is "id" for a service ID that is already registered, and "port"
+	// for an IP and port
+	Kind      string `json:"kind"`
+	ID        string `json:"id"`
+	Container string `json:"container"`
+	// With is the container holding the ID or endpoint, or "node:<node-id>"
+	// for a service of another host
+	With string `json:"with"`
+	// Resolution is "rejected", "suffixed" or "replaced"
+	Resolution string `json:"resolution"`
+}
+
+// ConflictReport counts the conflicts since Registrator started, by
+// "<kind>/<resolution>", and lists the recent ones, latest last.
+type ConflictReport struct {
+	Counts map[string]int `json:"counts"`
+	Recent []Conflict     `json:"recent"`
+}
+
+// conflict is a service a service about to be written collides with: one of
+// another container, or of another host.
+type conflict struct {
+	kind      string
+	holder    *Service
+	container string
+	node      string
+}
+
+func (c *conflict) with() string {
+	if c.node != "" {
+		return "node:" + c.node
+	}
+	return c.container
+}
+
+func (c *conflict) String() string {
+	if c.node != "" {
+		return "node " + c.node
+	}
+	return c.container[:12]
+}
+
+// endpoint identifies the IP, port and protocol a service is bound to, or
+// returns "" for a service without a port. Services advertising another
+// endpoint with SERVICE_ADDRESS or SERVICE_PORT, e.g. a load balancer that
+// several services share, claim none.
+func endpoint(service *Service) string {
+	origin := service.Origin
+	if origin.Port == 0 || service.IP != origin.IP || service.Port != origin.Port {
+		return ""
+	}
+	portType := origin.PortType
+	if portType == "" {
+		portType = "tcp"
+	}
+	return fmt.Sprintf("%s:%d/%s", origin.IP, origin.Port, portType)
+}
+
+// holds reports whether a service holds its ID and endpoint in the registry
+// against other services: it is registered, or being registered, for a
+// running container. Services kept for exited containers give way.
+func holds(service *Service) bool {
+	switch service.State() {
+	case StateRegistering, StateRegistered, StateDraining:
+		return true
+	}
+	return false
+}
+
+// findConflict returns what a service of a container collides with: a service
+// of another container registered with the same ID or on the same endpoint,
+// or a service of another host registered with the same ID, or nil. It is
+// called with the bridge lock held.
+func (b *Bridge) findConflict(containerId string, service *Service) *conflict {
+	key := endpoint(service)
+	var found *conflict
+	for otherId, services := range b.services {
+		if otherId == containerId {
+			continue
+		}
+		for _, other := range services {
+			if !holds(other) {
+				continue
+			}
+			if other.ID == service.ID {
+				return &conflict{kind: conflictID, holder: other, container: otherId}
+			}
+			if found == nil && key != "" && endpoint(other) == key {
+				found = &conflict{kind: conflictPort, holder: other, container: otherId}
+			}
+		}
+	}
+	if node := b.foreign[service.ID]; node != "" {
+		return &conflict{kind: conflictID, node: node}
+	}
+	return found
+}
+
+// heldByOther reports whether another container holds the ID of a service,
+// in which case deregistering the service would remove the other's entry. It
+// is called with the bridge lock held.
+func (b *Bridge) heldByOther(containerId string, service *Service) bool {
+	for otherId, services := range b.services {
+		if otherId == containerId {
+			continue
+		}
+		for _, other := range services {
+			if other.ID == service.ID && holds(other) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claim resolves the conflict of a service about to be written, per
+// -conflict-policy. It reports false if the service has to stay pending. A
+// service that was displaced by another one only comes back once that one is
+// gone, so that two services don't take turns.
+func (b *Bridge) claim(containerId string, service *Service) bool {
+	b.Lock()
+	c := b.findConflict(containerId, service)
+	if c == nil {
+		service.displaced = false
+		service.conflict = ""
+		b.Unlock()
+		return true
+	}
+	policy := b.conflictPolicy
+	if policy == ConflictSuffix && c.kind == conflictPort {
+		policy = ConflictReject
+	}
+	if policy == ConflictLastWriterWins && service.displaced {
+		policy = ConflictReject
+	}
+	switch policy {
+	case ConflictSuffix:
+		id := b.freeID(service.requested())
+		b.noteConflict(containerId, service, c, "suffixed")
+		if service.requestedID == "" {
+			service.requestedID = service.ID
+		}
+		service.ID = id
+		service.conflict = ""
+		b.Unlock()
+		log.Println("conflict:", service.requestedID, "registered as", id)
+		return true
+	case ConflictReject:
+		b.noteConflict(containerId, service, c, "rejected")
+		b.Unlock()
+		return false
+	}
+	b.Unlock()
+
+	if c.holder != nil && !b.displace(c, containerId) {
+		// busy, the next sync tries again
+		return false
+	}
+	b.Lock()
+	b.noteConflict(containerId, service, c, "replaced")
+	service.conflict = ""
+	service.displaced = false
+	b.Unlock()
+	return true
+}
+
+// displace takes the service a conflict is with out of the registry, for a
+// service of another container to take its place. It leaves the service
+// pending until that one is gone, and reports false if its container is busy.
+func (b *Bridge) displace(c *conflict, containerId string) bool {
+	unlock, ok := b.containers.tryLock(c.container)
+	if !ok {
+		return false
+	}
+	defer unlock()
+
+	b.Lock()
+	held := holds(c.holder)
+	b.Unlock()
+	if !held {
+		return true
+	}
+	if c.kind == conflictPort {
+		// the ID differs, so the entry isn't simply overwritten
+		if err := b.registry.Deregister(c.holder); err != nil {
+			log.Println("deregister failed:", c.holder.ID, err)
+			return false
+		}
+	}
+	b.Lock()
+	c.holder.transition(StatePending, "displaced by "+containerId[:12])
+	c.holder.displaced = true
+	b.Unlock()
+	log.Println("displaced:", c.container[:12], c.holder.ID)
+	return true
+}
+
+// displacedBy takes a registered service out of the way of a service another
+// host registered with its ID, which the registry listed instead of it.
+func (b *Bridge) displacedBy(containerId string, service *Service, node string) {
+	b.Lock()
+	service.transition(StatePending, "displaced by node "+node)
+	service.displaced = true
+	b.Unlock()
+	log.Println("displaced:", containerId[:12], service.ID, "by node", node)
+}
+
+// freeID returns the ID with the lowest suffix no tracked service, nor one of
+// another host, uses. It is called with the bridge lock held.
+func (b *Bridge) freeID(id string) string {
+	used := make(map[string]bool)
+	for _, services := range b.services {
+		for _, service := range services {
+			used[service.ID] = true
+		}
+	}
+	for n := 2; ; n++ {
+		candidate := id + "-" + strconv.Itoa(n)
+		if !used[candidate] && b.foreign[candidate] == "" {
+			return candidate
+		}
+	}
+}
+
+// noteConflict logs and counts a conflict, unless the service is still
+// rejected for the same one as last time. It is called with the bridge lock
+// held.
+func (b *Bridge) noteConflict(containerId string, service *Service, c *conflict, resolution string) {
+	note := c.kind + " " + c.with() + " " + resolution
+	if service.conflict == note {
+		return
+	}
+	service.conflict = note
+
+	log.Printf("conflict: %s of %s has the same %s as %s, %s",
+		service.ID, containerId[:12], c.kind, c, resolution)
+	if b.conflicts.Counts == nil {
+		b.conflicts.Counts = make(map[string]int)
+	}
+	b.conflicts.Counts[c.kind+"/"+resolution]++
+	b.conflicts.Recent = append(b.conflicts.Recent, Conflict{
+		Time:       time.Now(),
+		Kind:       c.kind,
+		ID:         service.ID,
+		Container:  containerId,
+		With:       c.with(),
+		Resolution: resolution,
+	})
+	if len(b.conflicts.Recent) > maxConflicts {
+		b.conflicts.Recent = b.conflicts.Recent[len(b.conflicts.Recent)-maxConflicts:]
+	}
+}
+
+// Conflicts returns the conflicts between services so far.
+func (b *Bridge) Conflicts() ConflictReport {
+	b.Lock()
+	defer b.Unlock()
+	report := ConflictReport{
+		Counts: make(map[string]int, len(b.conflicts.Counts)),
+		Recent: append([]Conflict{}, b.conflicts.Recent...),
+	}
+	for key, n := range b.conflicts.Counts {
+		report.Counts[key] = n
+	}
+	return report
+}
+
+// requested returns the ID the service was derived with, before a suffix
+// was appended to resolve a conflict.
+func (s *Service) requested() string {
+	if s.requestedID != "" {
+		return s.requestedID
+	}
+	return s.ID
+}
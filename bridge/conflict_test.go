@@ -0,0 +1,179 @@
+package bridge
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	for text, expected := range map[string]string{
+		"":                 ConflictLastWriterWins,
+		"last-writer-wins": ConflictLastWriterWins,
+		"reject":           ConflictReject,
+		" suffix ":         ConflictSuffix,
+	} {
+		policy, err := parseConflictPolicy(text)
+		assert.NoError(t, err, text)
+		assert.Equal(t, expected, policy, text)
+	}
+	_, err := parseConflictPolicy("first-writer-wins")
+	assert.Error(t, err)
+}
+
+// conflictBridge returns a bridge with running containers named after names,
+// whose services have the given environment, each on its own host port.
+func conflictBridge(t *testing.T, config Config, env []string, names ...string) (*Bridge, *recordingAdapter) {
+	b := testBridge(t, config)
+	registry := new(recordingAdapter)
+	b.registry = registry
+	docker := &fakeDocker{containers: make(map[string]*dockerapi.Container)}
+	for i, name := range names {
+		container := testContainer(env, "80/tcp")
+		container.ID = strings.Repeat(name, 32)
+		container.Name = "/" + name
+		container.NetworkSettings.Ports["80/tcp"][0].HostPort = strconv.Itoa(32768 + i)
+		container.State.Running = true
+		docker.containers[container.ID] = container
+	}
+	b.docker = docker
+	return b, registry
+}
+
+func TestConflictLastWriterWins(t *testing.T) {
+	b, registry := conflictBridge(t, Config{}, []string{"SERVICE_ID=web"}, "a", "b")
+	a, c := strings.Repeat("a", 32), strings.Repeat("b", 32)
+
+	b.Add(a)
+	b.Add(c)
+	assert.Equal(t, []string{"register web", "register web"}, registry.Calls())
+	assert.Equal(t, StatePending, b.services[a][0].State())
+	assert.Equal(t, StateRegistered, b.services[c][0].State())
+
+	// the displaced service doesn't take the ID back, it waits
+	b.Sync(true)
+	assert.Equal(t, StatePending, b.services[a][0].State())
+	assert.Equal(t, map[string]int{"id/replaced": 1, "id/rejected": 1}, b.Conflicts().Counts)
+
+	delete(b.docker.(*fakeDocker).containers, c)
+	b.Remove(c)
+	b.Sync(true)
+	assert.Equal(t, StateRegistered, b.services[a][0].State())
+	assert.Equal(t, []string{
+		"register web",
+		"register web",
+		// the registry lists nothing, so the sync writes it again
+		"register web",
+		"deregister web",
+		"register web",
+	}, registry.Calls())
+}
+
+func TestConflictReject(t *testing.T) {
+	b, registry := conflictBridge(t, Config{ConflictPolicy: "reject"}, []string{"SERVICE_ID=web"}, "a", "b")
+	a, c := strings.Repeat("a", 32), strings.Repeat("b", 32)
+
+	b.Add(a)
+	b.Add(c)
+	assert.Equal(t, []string{"register web"}, registry.Calls())
+	assert.Equal(t, StatePending, b.services[c][0].State())
+
+	report := b.Conflicts()
+	assert.Equal(t, map[string]int{"id/rejected": 1}, report.Counts)
+	assert.Equal(t, Conflict{Time: report.Recent[0].Time, Kind: "id", ID: "web", Container: c, With: a,
+		Resolution: "rejected"}, report.Recent[0])
+
+	delete(b.docker.(*fakeDocker).containers, a)
+	b.Remove(a)
+	b.Sync(true)
+	assert.Equal(t, StateRegistered, b.services[c][0].State())
+	assert.Equal(t, []string{"register web", "deregister web", "register web"}, registry.Calls())
+}
+
+func TestConflictSuffix(t *testing.T) {
+	b, registry := conflictBridge(t, Config{ConflictPolicy: "suffix"}, []string{"SERVICE_ID=web"}, "a", "b", "c")
+
+	b.Add(strings.Repeat("a", 32))
+	b.Add(strings.Repeat("b", 32))
+	b.Add(strings.Repeat("c", 32))
+	assert.Equal(t, []string{"register web", "register web-2", "register web-3"}, registry.Calls())
+
+	// the suffixed service is kept as it is when its container is updated
+	b.Update(strings.Repeat("b", 32))
+	assert.Equal(t, "web-2", b.services[strings.Repeat("b", 32)][0].ID)
+	assert.Len(t, registry.Calls(), 3)
+}
+
+func TestPortConflict(t *testing.T) {
+	b, registry := conflictBridge(t, Config{ConflictPolicy: "suffix"}, nil, "a", "b")
+	a, c := strings.Repeat("a", 32), strings.Repeat("b", 32)
+	docker := b.docker.(*fakeDocker)
+	docker.containers[c].NetworkSettings.Ports["80/tcp"][0].HostPort = "32768"
+
+	b.Add(a)
+	b.Add(c)
+	assert.Equal(t, []string{"register " + Hostname + ":a:80"}, registry.Calls())
+	assert.Equal(t, map[string]int{"port/rejected": 1}, b.Conflicts().Counts)
+
+	b.config.ConflictPolicy, b.conflictPolicy = ConflictLastWriterWins, ConflictLastWriterWins
+	// listed, so that the sync doesn't write it again
+	registry.registered = b.services[a]
+	b.Sync(true)
+	assert.Equal(t, []string{
+		"register " + Hostname + ":a:80",
+		"deregister " + Hostname + ":a:80",
+		"register " + Hostname + ":b:80",
+	}, registry.Calls())
+	assert.Equal(t, StatePending, b.services[a][0].State())
+}
+
+func TestSharedAdvertisedEndpoint(t *testing.T) {
+	b, registry := conflictBridge(t, Config{}, []string{"SERVICE_ADDRESS=lb.internal", "SERVICE_PORT=443"}, "a", "b")
+	for _, name := range []string{"a", "b"} {
+		container := b.docker.(*fakeDocker).containers[strings.Repeat(name, 32)]
+		container.Config.Env = append([]string{"SERVICE_NAME=svc" + name}, container.Config.Env...)
+	}
+
+	// bound to different host ports, both behind the same load balancer
+	b.Add(strings.Repeat("a", 32))
+	b.Add(strings.Repeat("b", 32))
+	assert.Equal(t, []string{"register " + Hostname + ":a:80", "register " + Hostname + ":b:80"}, registry.Calls())
+	assert.Empty(t, b.Conflicts().Counts)
+}
+
+func TestDeadServiceKeepsHolder(t *testing.T) {
+	b, registry := conflictBridge(t, Config{RefreshTtl: 60, RefreshInterval: 30},
+		[]string{"SERVICE_ID=web", "SERVICE_DEREGISTER=keep"}, "a", "b")
+	a, c := strings.Repeat("a", 32), strings.Repeat("b", 32)
+
+	b.Add(a)
+	b.RemoveOnExit(a)
+	assert.Equal(t, StateDead, b.services[a][0].State())
+
+	// the replacement takes over the ID of the dead service without a conflict
+	b.Add(c)
+	b.Remove(a)
+	assert.Equal(t, []string{"register web", "register web"}, registry.Calls())
+	assert.Empty(t, b.Conflicts().Counts)
+}
+
+func TestConflictAcrossHosts(t *testing.T) {
+	b, registry := conflictBridge(t, Config{NodeID: "node-a", ConflictPolicy: "reject"},
+		[]string{"SERVICE_ID=web"}, "a")
+	a := strings.Repeat("a", 32)
+
+	b.Add(a)
+	registry.registered = []*Service{{ID: "web", Name: "web", Owner: &Owner{Node: "node-b"}}}
+	b.Sync(true)
+	assert.Equal(t, StatePending, b.services[a][0].State())
+	assert.Equal(t, map[string]int{"id/rejected": 1}, b.Conflicts().Counts)
+	assert.Equal(t, []string{"register web"}, registry.Calls())
+
+	registry.registered = nil
+	b.Sync(true)
+	assert.Equal(t, StateRegistered, b.services[a][0].State())
+	assert.Equal(t, []string{"register web", "register web"}, registry.Calls())
+}
@@ -0,0 +1,102 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ControlHandler serves the local control endpoint:
+//
+//	GET    /maintenance                      current maintenance state
+//	PUT    /maintenance[?reason=...]         host maintenance on
+//	DELETE /maintenance                      host maintenance off
+//	PUT    /maintenance/containers/<container>[?reason=...]
+//	DELETE /maintenance/containers/<container>
+//	PUT    /maintenance/services/<service-id>[?reason=...]
+//	DELETE /maintenance/services/<service-id>
+//	GET    /flapping                         containers suppressed by flap dampening
+//	GET    /services                         lifecycle state of the tracked services
+//	GET    /cleanup                          report of the last cleanup
+//	GET    /conflicts                        conflicts between services so far
+//
+// Containers are given by ID, ID prefix or name. Deleting the maintenance of
+// a container or service explicitly turns it off, overriding its metadata.
+func (b *Bridge) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/maintenance", b.serveMaintenance)
+	mux.HandleFunc("/maintenance/", b.serveMaintenance)
+	mux.HandleFunc("/flapping", b.serveFlapping)
+	mux.HandleFunc("/services", b.serveServices)
+	mux.HandleFunc("/cleanup", b.serveCleanup)
+	mux.HandleFunc("/conflicts", b.serveConflicts)
+	return mux
+}
+
+func (b *Bridge) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	var enabled bool
+	switch r.Method {
+	case "GET":
+		if r.URL.Path != "/maintenance" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.Maintenance())
+		return
+	case "PUT", "POST":
+		enabled = true
+	case "DELETE":
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/maintenance"), "/", 3)
+	var err error
+	switch {
+	case len(parts) == 1 && parts[0] == "":
+		b.SetHostMaintenance(enabled, reason)
+	case len(parts) == 3 && parts[1] == "containers" && parts[2] != "":
+		err = b.SetContainerMaintenance(parts[2], enabled, reason)
+	case len(parts) == 3 && parts[1] == "services" && parts[2] != "":
+		err = b.SetServiceMaintenance(parts[2], enabled, reason)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *Bridge) serveFlapping(w http.ResponseWriter, r *http.Request) {
+	serveJSON(w, r, func() interface{} { return b.Flapping() })
+}
+
+func (b *Bridge) serveServices(w http.ResponseWriter, r *http.Request) {
+	serveJSON(w, r, func() interface{} { return b.ServiceStates() })
+}
+
+func (b *Bridge) serveCleanup(w http.ResponseWriter, r *http.Request) {
+	serveJSON(w, r, func() interface{} { return b.Cleanup() })
+}
+
+func (b *Bridge) serveConflicts(w http.ResponseWriter, r *http.Request) {
+	serveJSON(w, r, func() interface{} { return b.Conflicts() })
+}
+
+// serveJSON serves the result of a read-only endpoint as JSON.
+func serveJSON(w http.ResponseWriter, r *http.Request, get func() interface{}) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(get())
+}
@@ -0,0 +1,222 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSourceTimeout bounds a lookup when no timeout is configured.
+const defaultSourceTimeout = 10 * time.Second
+
+type fetchFunc func(ctx context.Context, key string) ([]byte, error)
+
+// dataSource caches the results of an external lookup used by templates.
+//
+// A ttl of 0 disables the cache: every lookup is fetched. Otherwise a value
+// younger than ttl is served from the cache. An older value is still
+// served while it is younger than ttl+stale, and refreshed in the background,
+// so that a slow endpoint only ever delays the very first lookup of a key.
+// Failed lookups are cached like successful ones: the previous value is kept
+// if there is one, an empty value otherwise.
+type dataSource struct {
+	name    string
+	ttl     time.Duration
+	stale   time.Duration
+	timeout time.Duration
+	fetch   fetchFunc
+
+	mu      sync.Mutex
+	entries map[string]*dataEntry
+}
+
+type dataEntry struct {
+	value   []byte
+	fetched time.Time
+	// done is closed when an in-flight fetch for this entry completes
+	done chan struct{}
+}
+
+func newDataSource(name string, ttl, stale, timeout time.Duration, fetch fetchFunc) *dataSource {
+	if timeout <= 0 {
+		timeout = defaultSourceTimeout
+	}
+	return &dataSource{
+		name:    name,
+		ttl:     ttl,
+		stale:   stale,
+		timeout: timeout,
+		fetch:   fetch,
+		entries: make(map[string]*dataEntry),
+	}
+}
+
+func (s *dataSource) Get(key string) []byte {
+	if s.ttl <= 0 {
+		return s.lookup(key)
+	}
+
+	s.mu.Lock()
+	e := s.entries[key]
+	if e == nil {
+		e = &dataEntry{}
+		s.entries[key] = e
+	}
+	age := time.Since(e.fetched)
+	switch {
+	case !e.fetched.IsZero() && age < s.ttl:
+		value := e.value
+		s.mu.Unlock()
+		return value
+	case !e.fetched.IsZero() && age < s.ttl+s.stale:
+		value := e.value
+		if e.done == nil {
+			e.done = make(chan struct{})
+			go s.update(key, e)
+		}
+		s.mu.Unlock()
+		return value
+	}
+
+	done := e.done
+	if done == nil {
+		done = make(chan struct{})
+		e.done = done
+		s.mu.Unlock()
+		s.update(key, e)
+	} else {
+		s.mu.Unlock()
+		<-done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return e.value
+}
+
+// lookup fetches a value without caching it, and returns an empty value if
+// the lookup fails.
+func (s *dataSource) lookup(key string) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	value, err := s.fetch(ctx, key)
+	if err != nil {
+		log.Printf("%s template function failed for %q: %v", s.name, key, err)
+		return []byte("")
+	}
+	return value
+}
+
+func (s *dataSource) update(key string, e *dataEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	value, err := s.fetch(ctx, key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		log.Printf("%s template function failed for %q: %v", s.name, key, err)
+		if e.fetched.IsZero() {
+			e.value = []byte("")
+		}
+	} else {
+		e.value = value
+	}
+	e.fetched = time.Now()
+	close(e.done)
+	e.done = nil
+}
+
+// withTimeout runs a blocking fn and gives up when ctx is done.
+func withTimeout(ctx context.Context, fn func() ([]byte, error)) ([]byte, error) {
+	type result struct {
+		value []byte
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		value, err := fn()
+		ch <- result{value, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.value, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func fetchHTTP(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+func fetchFile(ctx context.Context, path string) ([]byte, error) {
+	return withTimeout(ctx, func() ([]byte, error) {
+		return ioutil.ReadFile(path)
+	})
+}
+
+func fetchDNS(ctx context.Context, name string) ([]byte, error) {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(addrs, "\n")), nil
+}
+
+// fetchers are the lookups behind the template data sources, by function
+// name.
+var fetchers = map[string]fetchFunc{
+	"httpGet":   fetchHTTP,
+	"fileRead":  fetchFile,
+	"jsonFile":  fetchFile,
+	"dnsLookup": fetchDNS,
+}
+
+// TemplateSources returns the names of the template data sources, which
+// -template-source-timeouts accepts.
+func TemplateSources() []string {
+	names := make([]string, 0, len(fetchers))
+	for name := range fetchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newDataSources builds the template data sources from the bridge config.
+func newDataSources(config Config) map[string]*dataSource {
+	ttl := time.Duration(config.TemplateCacheTtl) * time.Second
+	stale := time.Duration(config.TemplateCacheStale) * time.Second
+	timeout := func(name string) time.Duration {
+		if ms, ok := config.TemplateSourceTimeouts[name]; ok {
+			return time.Duration(ms) * time.Millisecond
+		}
+		return time.Duration(config.TemplateTimeout) * time.Millisecond
+	}
+
+	sources := make(map[string]*dataSource)
+	for name, fetch := range fetchers {
+		sources[name] = newDataSource(name, ttl, stale, timeout(name), fetch)
+	}
+	return sources
+}
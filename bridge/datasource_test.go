@@ -0,0 +1,77 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func countingFetch(calls *int32, value string, err error) fetchFunc {
+	return func(ctx context.Context, key string) ([]byte, error) {
+		atomic.AddInt32(calls, 1)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(value + ":" + key), nil
+	}
+}
+
+func TestDataSourceCachesWithinTtl(t *testing.T) {
+	var calls int32
+	s := newDataSource("test", time.Minute, 0, time.Second, countingFetch(&calls, "v", nil))
+
+	assert.Equal(t, "v:a", string(s.Get("a")))
+	assert.Equal(t, "v:a", string(s.Get("a")))
+	assert.Equal(t, "v:b", string(s.Get("b")))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestDataSourceServesStaleWhileRevalidating(t *testing.T) {
+	var calls int32
+	s := newDataSource("test", time.Millisecond, time.Minute, time.Second, countingFetch(&calls, "v", nil))
+	s.entries["a"] = &dataEntry{value: []byte("old"), fetched: time.Now().Add(-time.Second)}
+
+	assert.Equal(t, "old", string(s.Get("a")))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDataSourceKeepsValueOnError(t *testing.T) {
+	var calls int32
+	s := newDataSource("test", time.Millisecond, 0, time.Second, countingFetch(&calls, "", errors.New("boom")))
+	s.entries["a"] = &dataEntry{value: []byte("old"), fetched: time.Now().Add(-time.Second)}
+
+	assert.Equal(t, "old", string(s.Get("a")))
+	assert.Equal(t, "", string(s.Get("b")))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestDataSourceWithoutCache(t *testing.T) {
+	var calls int32
+	s := newDataSource("test", 0, time.Minute, time.Second, countingFetch(&calls, "v", nil))
+
+	assert.Equal(t, "v:a", string(s.Get("a")))
+	assert.Equal(t, "v:a", string(s.Get("a")))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+	assert.Empty(t, s.entries)
+}
+
+func TestDataSourceTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	s := newDataSource("test", time.Minute, 0, 10*time.Millisecond, func(ctx context.Context, key string) ([]byte, error) {
+		return withTimeout(ctx, func() ([]byte, error) {
+			<-block
+			return []byte("late"), nil
+		})
+	})
+
+	start := time.Now()
+	assert.Equal(t, "", string(s.Get("a")))
+	assert.True(t, time.Since(start) < time.Second)
+}
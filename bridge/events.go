@@ -0,0 +1,186 @@
+package bridge
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// inspectConcurrency bounds the containers of a batch inspected and
+// registered at once.
+const inspectConcurrency = 8
+
+// Actions taken on the Docker events of a container.
+const (
+	actionStart   = "start"
+	actionDie     = "die"
+	actionKill    = "kill"
+	actionUpdate  = "update"
+	actionHealth  = "health"
+	actionDestroy = "destroy"
+)
+
+// eventAction returns what to do about an event, and for which container.
+func eventAction(msg *dockerapi.APIEvents) (string, string) {
+	if msg.Type == "network" {
+		switch msg.Action {
+		case "connect", "disconnect":
+			return actionUpdate, msg.Actor.Attributes["container"]
+		}
+		return "", ""
+	}
+	if strings.HasPrefix(msg.Status, "health_status") {
+		// "health_status: healthy"
+		return actionHealth, msg.ID
+	}
+	switch msg.Status {
+	case "start":
+		return actionStart, msg.ID
+	case "die":
+		return actionDie, msg.ID
+	case "destroy":
+		return actionDestroy, msg.ID
+	case "kill":
+		if stopSignal(msg.Actor.Attributes["signal"]) {
+			return actionKill, msg.ID
+		}
+	}
+	return "", ""
+}
+
+// stopSignal reports whether a signal sent to a container, as given by the
+// "kill" event, usually stops it. Signals used to reload or reopen logs don't.
+func stopSignal(signal string) bool {
+	switch strings.TrimPrefix(strings.ToUpper(signal), "SIG") {
+	case "", "2", "3", "9", "15", "INT", "QUIT", "KILL", "TERM":
+		return true
+	}
+	return false
+}
+
+// HandleEvents acts on Docker events until the channel is closed. With a
+// window, events are collected for that long after the first one, reduced
+// to the last relevant action per container, and handled as a batch. Batches
+// are handled one after another, so that the actions on a container keep the
+// order of its events, while the next batch is collected.
+func (b *Bridge) HandleEvents(events <-chan *dockerapi.APIEvents, window time.Duration) {
+	if window <= 0 {
+		for msg := range events {
+			if action, containerId := eventAction(msg); containerId != "" {
+				go b.handle(action, containerId)
+			}
+		}
+		return
+	}
+
+	type batch struct {
+		pending map[string]string
+		order   []string
+	}
+	batches := make(chan batch, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for queued := range batches {
+			b.handleBatch(queued.pending, queued.order)
+		}
+	}()
+
+	var pending map[string]string
+	var order []string
+	var flush <-chan time.Time
+	var ready []batch
+	for {
+		// hand the oldest collected batch to the handler once it is idle
+		var next chan<- batch
+		var first batch
+		if len(ready) > 0 {
+			next, first = batches, ready[0]
+		}
+		select {
+		case msg, ok := <-events:
+			if !ok {
+				if pending != nil {
+					ready = append(ready, batch{pending, order})
+				}
+				for _, queued := range ready {
+					batches <- queued
+				}
+				close(batches)
+				<-done
+				return
+			}
+			action, containerId := eventAction(msg)
+			if containerId == "" {
+				continue
+			}
+			if pending == nil {
+				pending = make(map[string]string)
+				order = nil
+				flush = time.After(window)
+			}
+			_, seen := pending[containerId]
+			if !seen {
+				order = append(order, containerId)
+			}
+			if seen && (action == actionHealth || (action == actionUpdate && pending[containerId] != actionHealth)) {
+				// starts, stops and exits cover network and health
+				// changes, and updates cover health changes
+				continue
+			}
+			pending[containerId] = action
+		case <-flush:
+			ready = append(ready, batch{pending, order})
+			pending, order, flush = nil, nil, nil
+		case next <- first:
+			ready = ready[1:]
+		}
+	}
+}
+
+func (b *Bridge) handle(action, containerId string) {
+	switch action {
+	case actionStart:
+		b.Add(containerId)
+	case actionDie:
+		b.RemoveOnExit(containerId)
+	case actionKill:
+		b.Drain(containerId)
+	case actionUpdate:
+		b.Update(containerId)
+	case actionHealth:
+		b.Health(containerId)
+	case actionDestroy:
+		b.Destroy(containerId)
+	}
+}
+
+// handleBatch handles the collected actions, in the order containers first
+// appeared. Started containers are inspected and registered in parallel.
+func (b *Bridge) handleBatch(pending map[string]string, order []string) {
+	var started []string
+	var wg sync.WaitGroup
+	for _, containerId := range order {
+		if pending[containerId] == actionStart {
+			started = append(started, containerId)
+			continue
+		}
+		wg.Add(1)
+		go func(action, containerId string) {
+			defer wg.Done()
+			b.handle(action, containerId)
+		}(pending[containerId], containerId)
+	}
+	log.Printf("Handling events of %d containers, %d started", len(order), len(started))
+	b.AddBatch(started)
+	wg.Wait()
+}
+
+// AddBatch registers the services of several started containers, inspecting
+// and registering them in parallel.
+func (b *Bridge) AddBatch(containerIds []string) {
+	parallel(containerIds, inspectConcurrency, b.Add)
+}
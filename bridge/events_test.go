@@ -0,0 +1,93 @@
+package bridge
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleEventsBatch(t *testing.T) {
+	b := testBridge(t, Config{})
+	registry := new(recordingAdapter)
+	b.registry = registry
+	docker := &fakeDocker{containers: make(map[string]*dockerapi.Container)}
+	b.docker = docker
+	for i, name := range []string{"a", "b", "c"} {
+		container := testContainer(nil, "80/tcp")
+		container.ID = strings.Repeat(name, 32)
+		container.Name = "/" + name
+		container.NetworkSettings.Ports["80/tcp"][0].HostPort = strconv.Itoa(32768 + i)
+		container.State.Running = name != "b"
+		docker.containers[container.ID] = container
+	}
+	id := func(name string) string { return strings.Repeat(name, 32) }
+	network := func(action, containerId string) *dockerapi.APIEvents {
+		msg := &dockerapi.APIEvents{Type: "network", Action: action}
+		msg.Actor.Attributes = map[string]string{"container": containerId}
+		return msg
+	}
+	reload := &dockerapi.APIEvents{Status: "kill", ID: id("a")}
+	reload.Actor.Attributes = map[string]string{"signal": "1"}
+
+	events := make(chan *dockerapi.APIEvents, 10)
+	events <- &dockerapi.APIEvents{Status: "start", ID: id("a")}
+	events <- network("connect", id("a"))
+	events <- reload
+	events <- &dockerapi.APIEvents{Status: "start", ID: id("b")}
+	events <- &dockerapi.APIEvents{Status: "die", ID: id("b")}
+	events <- network("connect", id("c"))
+	events <- &dockerapi.APIEvents{Status: "create", ID: id("c")}
+	close(events)
+
+	b.HandleEvents(events, time.Hour)
+	calls := registry.Calls()
+	sort.Strings(calls)
+	assert.Equal(t, []string{"register " + Hostname + ":a:80", "register " + Hostname + ":c:80"}, calls)
+}
+
+func TestHandleEventsInOrder(t *testing.T) {
+	b := testBridge(t, Config{})
+	registry := new(recordingAdapter)
+	b.registry = registry
+	container := testContainer(nil, "80/tcp")
+	container.State.Running = true
+	docker := &fakeDocker{containers: map[string]*dockerapi.Container{container.ID: container}}
+	b.docker = docker
+
+	events := make(chan *dockerapi.APIEvents)
+	done := make(chan struct{})
+	go func() {
+		b.HandleEvents(events, time.Millisecond)
+		close(done)
+	}()
+	events <- &dockerapi.APIEvents{Status: "start", ID: container.ID}
+	time.Sleep(10 * time.Millisecond)
+	exited := *container
+	exited.State.Running = false
+	docker.mu.Lock()
+	docker.containers[container.ID] = &exited
+	docker.mu.Unlock()
+	events <- &dockerapi.APIEvents{Status: "die", ID: container.ID}
+	close(events)
+	<-done
+	assert.Equal(t, []string{"register " + Hostname + ":web.0:80", "deregister " + Hostname + ":web.0:80"},
+		registry.Calls())
+
+	// a start handled after the container exited registers nothing
+	b.Add(container.ID)
+	assert.Len(t, registry.Calls(), 2)
+}
+
+func TestStopSignal(t *testing.T) {
+	for _, signal := range []string{"", "15", "SIGTERM", "KILL", "9"} {
+		assert.True(t, stopSignal(signal), signal)
+	}
+	for _, signal := range []string{"1", "SIGHUP", "USR1", "28"} {
+		assert.False(t, stopSignal(signal), signal)
+	}
+}
@@ -0,0 +1,116 @@
+package bridge
+
+import (
+	"log"
+	"time"
+)
+
+// flapState tracks the starts of a container for flap dampening.
+type flapState struct {
+	starts     []time.Time
+	suppressed bool
+	timer      *time.Timer
+}
+
+// FlapStatus describes a container whose registration is suppressed because
+// it is flapping.
+type FlapStatus struct {
+	Starts    int       `json:"starts"`
+	LastStart time.Time `json:"last_start"`
+}
+
+func (b *Bridge) flapWindow() time.Duration {
+	return time.Duration(b.config.FlapWindow) * time.Second
+}
+
+// dampen records a start of a container, and reports whether its
+// registration is suppressed because it started -flap-threshold times within
+// -flap-window, in which case the caller deregisters its services.
+// Registration resumes once it stayed up for -flap-window.
+func (b *Bridge) dampen(containerId string) bool {
+	if b.config.FlapThreshold <= 0 {
+		return false
+	}
+	now := time.Now()
+	window := b.flapWindow()
+	for id, state := range b.flaps {
+		if !state.suppressed && now.Sub(state.starts[len(state.starts)-1]) >= window {
+			delete(b.flaps, id)
+		}
+	}
+	state := b.flaps[containerId]
+	if state == nil {
+		state = &flapState{}
+		b.flaps[containerId] = state
+	}
+	starts := state.starts[:0]
+	for _, t := range state.starts {
+		if now.Sub(t) < window {
+			starts = append(starts, t)
+		}
+	}
+	state.starts = append(starts, now)
+
+	if !state.suppressed && len(state.starts) < b.config.FlapThreshold {
+		return false
+	}
+	if !state.suppressed {
+		log.Printf("flapping: %s started %d times within %v, suppressing registration",
+			containerId[:12], len(state.starts), window)
+		state.suppressed = true
+	}
+	if state.timer != nil {
+		state.timer.Stop()
+	}
+	state.timer = time.AfterFunc(window, func() {
+		b.resume(containerId, state)
+	})
+	return true
+}
+
+// resume registers the services of a container again after it stopped
+// flapping.
+func (b *Bridge) resume(containerId string, state *flapState) {
+	unlock := b.containers.lock(containerId)
+	defer unlock()
+
+	container, err := b.docker.InspectContainer(containerId)
+
+	b.Lock()
+	if b.flaps[containerId] != state || time.Since(state.starts[len(state.starts)-1]) < b.flapWindow() {
+		// started again in the meantime
+		b.Unlock()
+		return
+	}
+	delete(b.flaps, containerId)
+	b.Unlock()
+	if err != nil || !container.State.Running {
+		log.Println("flapping:", containerId[:12], "stopped")
+		return
+	}
+	log.Println("stable:", containerId[:12], "up for", b.flapWindow(), "resuming registration")
+	b.add(containerId, false)
+}
+
+// suppressed reports whether the registration of a container is suppressed.
+func (b *Bridge) suppressed(containerId string) bool {
+	state := b.flaps[containerId]
+	return state != nil && state.suppressed
+}
+
+// Flapping returns the containers whose registration is suppressed.
+func (b *Bridge) Flapping() map[string]FlapStatus {
+	b.Lock()
+	defer b.Unlock()
+
+	flapping := make(map[string]FlapStatus)
+	for containerId, state := range b.flaps {
+		if state.suppressed {
+			flapping[containerId] = FlapStatus{
+				Starts:    len(state.starts),
+				LastStart: state.starts[len(state.starts)-1],
+			}
+		}
+	}
+	return flapping
+}
@@ -0,0 +1,55 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlapDampening(t *testing.T) {
+	b := testBridge(t, Config{FlapThreshold: 3, FlapWindow: 60})
+	registry := new(recordingAdapter)
+	b.registry = registry
+	container := testContainer(nil, "80/tcp")
+	container.State.Running = true
+	b.docker = &fakeDocker{containers: map[string]*dockerapi.Container{container.ID: container}}
+	id := Hostname + ":web.0:80"
+
+	b.Add(container.ID)
+	b.remove(container.ID, true)
+	b.Add(container.ID)
+	assert.Equal(t, []string{"register " + id, "deregister " + id, "register " + id}, registry.Calls())
+
+	// the third start within the window suppresses registration, and
+	// removes what is registered
+	b.Add(container.ID)
+	assert.Equal(t, "deregister "+id, registry.Calls()[3])
+	assert.Empty(t, b.services)
+	assert.Contains(t, b.Flapping(), container.ID)
+
+	b.Sync(true)
+	b.Update(container.ID)
+	assert.Len(t, registry.Calls(), 4)
+
+	// registration resumes once the container stayed up for the window
+	b.Lock()
+	state := b.flaps[container.ID]
+	state.timer.Stop()
+	for i := range state.starts {
+		state.starts[i] = state.starts[i].Add(-time.Minute)
+	}
+	b.Unlock()
+	b.resume(container.ID, state)
+	assert.Equal(t, "register "+id, registry.Calls()[4])
+	assert.Empty(t, b.Flapping())
+}
+
+func TestFlapDampeningDisabled(t *testing.T) {
+	b := testBridge(t, Config{})
+	for i := 0; i < 10; i++ {
+		assert.False(t, b.dampen("0123456789abcdef"))
+	}
+	assert.Empty(t, b.flaps)
+}
@@ -0,0 +1,115 @@
+package bridge
+
+import (
+	"log"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// Health statuses Docker reports for containers with a health check.
+const (
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// HealthAttr is the attribute the services of a container with a Docker
+// health check carry its health status in. Unhealthy services also carry the
+// output of the last check in the "unhealthy" status attribute, which takes
+// them out of rotation.
+const HealthAttr = "health"
+
+// containerHealth returns the health status of a container and the first line
+// of the output of its last check, or "" for a container without a health
+// check.
+func containerHealth(container *dockerapi.Container) (string, string) {
+	health := container.State.Health
+	if health.Status == "none" {
+		return "", ""
+	}
+	var output string
+	if n := len(health.Log); n > 0 {
+		output = strings.TrimSpace(health.Log[n-1].Output)
+		if i := strings.IndexByte(output, '\n'); i >= 0 {
+			output = output[:i]
+		}
+	}
+	return health.Status, output
+}
+
+// setHealth sets the health attributes of a service.
+func setHealth(service *Service, status, output string) {
+	if service.Attrs == nil {
+		service.Attrs = make(map[string]string)
+	}
+	if status == "" {
+		delete(service.Attrs, HealthAttr)
+		delete(service.Attrs, "unhealthy")
+		return
+	}
+	service.Attrs[HealthAttr] = status
+	if status != HealthUnhealthy {
+		delete(service.Attrs, "unhealthy")
+		return
+	}
+	if output == "" {
+		output = "true"
+	}
+	service.Attrs["unhealthy"] = output
+}
+
+// Health updates the services of a container after Docker reported a change
+// of its health status, and writes their status to the registry.
+func (b *Bridge) Health(containerId string) {
+	unlock := b.containers.lock(containerId)
+	defer unlock()
+
+	container, err := b.docker.InspectContainer(containerId)
+	if err != nil {
+		log.Println("unable to inspect container:", containerId[:12], err)
+		return
+	}
+	if !container.State.Running {
+		// the services go with the exit of the container
+		return
+	}
+	b.updateHealth(container)
+}
+
+// updateHealth applies the health status of a container to its services, if
+// it changed, and writes the status of those in the registry. Pending services
+// are written with it later.
+func (b *Bridge) updateHealth(container *dockerapi.Container) {
+	status, output := containerHealth(container)
+	b.Lock()
+	if b.health[container.ID] == status {
+		b.Unlock()
+		return
+	}
+	b.setContainerHealth(container.ID, status)
+	var update []*Service
+	for _, service := range b.services[container.ID] {
+		setHealth(service, status, output)
+		if service.inRegistry() {
+			update = append(update, service)
+		}
+	}
+	b.Unlock()
+
+	log.Println("health:", container.ID[:12], status)
+	for _, service := range update {
+		b.updateStatus(service)
+	}
+}
+
+// setContainerHealth remembers the health status of a container, which its
+// services were derived or updated with. It is called with the bridge lock
+// held.
+func (b *Bridge) setContainerHealth(containerId, status string) {
+	if status == "" {
+		delete(b.health, containerId)
+		return
+	}
+	b.health[containerId] = status
+}
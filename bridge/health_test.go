@@ -0,0 +1,96 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func withHealth(container *dockerapi.Container, status, output string) {
+	container.State.Health = dockerapi.Health{
+		Status: status,
+		Log:    []dockerapi.HealthCheck{{ExitCode: 1, Output: output}},
+	}
+}
+
+func TestSetHealth(t *testing.T) {
+	service := &Service{ID: "web"}
+	setHealth(service, HealthUnhealthy, "")
+	assert.Equal(t, map[string]string{"health": "unhealthy", "unhealthy": "true"}, service.Attrs)
+	assert.Equal(t, "unhealthy", service.Status())
+
+	setHealth(service, HealthStarting, "")
+	assert.Equal(t, map[string]string{"health": "starting"}, service.Attrs)
+	assert.Equal(t, "", service.Status())
+
+	setHealth(service, "", "")
+	assert.Empty(t, service.Attrs)
+}
+
+func TestHealthEvent(t *testing.T) {
+	action, containerId := eventAction(&dockerapi.APIEvents{Status: "health_status: unhealthy", ID: "abc"})
+	assert.Equal(t, actionHealth, action)
+	assert.Equal(t, "abc", containerId)
+}
+
+func TestHealthPropagated(t *testing.T) {
+	b := testBridge(t, Config{})
+	registry := new(recordingAdapter)
+	b.registry = registry
+	container := testContainer(nil, "80/tcp")
+	container.State.Running = true
+	withHealth(container, HealthStarting, "")
+	docker := &fakeDocker{containers: map[string]*dockerapi.Container{container.ID: container}}
+	b.docker = docker
+
+	b.Add(container.ID)
+	service := b.services[container.ID][0]
+	assert.Equal(t, "starting", service.Attrs[HealthAttr])
+
+	docker.mu.Lock()
+	withHealth(container, HealthUnhealthy, "connection refused\nretrying")
+	docker.mu.Unlock()
+	b.Health(container.ID)
+	assert.Equal(t, "connection refused", service.Attrs["unhealthy"])
+
+	// unchanged
+	b.Health(container.ID)
+
+	// updates look at the health too, without registering again
+	docker.mu.Lock()
+	withHealth(container, HealthHealthy, "ok")
+	docker.mu.Unlock()
+	b.Update(container.ID)
+	assert.Equal(t, StateRegistered, service.State())
+	assert.Equal(t, "healthy", service.Attrs[HealthAttr])
+	assert.Equal(t, []string{
+		"register " + service.ID,
+		"status:unhealthy " + service.ID,
+		"status: " + service.ID,
+	}, registry.Calls())
+}
+
+func TestHealthRegisteredUnavailable(t *testing.T) {
+	b := testBridge(t, Config{})
+	registry := new(recordingAdapter)
+	b.registry = registry
+	container := testContainer(nil, "80/tcp")
+	container.State.Running = true
+	withHealth(container, HealthUnhealthy, "")
+	b.docker = &fakeDocker{containers: map[string]*dockerapi.Container{container.ID: container}}
+
+	b.Add(container.ID)
+	service := b.services[container.ID][0]
+	assert.Equal(t, []string{"register " + service.ID, "status:unhealthy " + service.ID}, registry.Calls())
+	assert.Equal(t, "unhealthy", NewRecord(service).Status)
+}
+
+func TestHealthCheckTTLRefresh(t *testing.T) {
+	b := testBridge(t, Config{})
+	service := &Service{Attrs: map[string]string{"check_ttl": "30s"}}
+	assert.Equal(t, time.Duration(0), b.refreshInterval(service))
+	service.Attrs[HealthAttr] = HealthHealthy
+	assert.Equal(t, 15*time.Second, b.refreshInterval(service))
+}
@@ -0,0 +1,212 @@
+package bridge
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// State is the lifecycle state of a service tracked by the bridge.
+type State string
+
+const (
+	// StatePending services are derived from a container, but not written to
+	// the registry yet, their registration failed, or another service holds
+	// their ID or endpoint.
+	StatePending State = "pending"
+	// StateRegistering services are being written to the registry.
+	StateRegistering State = "registering"
+	// StateRegistered services are in the registry.
+	StateRegistered State = "registered"
+	// StateDraining services are out of rotation ahead of being deregistered.
+	StateDraining State = "draining"
+	// StateFailed services belong to a container that exited with a failure,
+	// and stay registered marked as failing.
+	StateFailed State = "failed"
+	// StateDead services belong to a container that exited, and stay
+	// registered until their TTL expires or the container comes back.
+	StateDead State = "dead"
+	// StateDeregistered services are removed from the registry, and no
+	// longer tracked.
+	StateDeregistered State = "deregistered"
+)
+
+// transitions lists the states a service may move to from each state.
+var transitions = map[State][]State{
+	StatePending:      {StateRegistering, StateDeregistered},
+	StateRegistering:  {StateRegistered, StatePending},
+	StateRegistered:   {StateDraining, StateFailed, StateDead, StateDeregistered, StatePending},
+	StateDraining:     {StateRegistered, StateFailed, StateDead, StateDeregistered, StatePending},
+	StateFailed:       {StateRegistered, StateDead, StateDeregistered},
+	StateDead:         {StateRegistered, StateFailed, StateDeregistered},
+	StateDeregistered: {},
+}
+
+// maxTransitions bounds the history kept per service.
+const maxTransitions = 16
+
+// Transition records a change of the lifecycle state of a service.
+type Transition struct {
+	State  State     `json:"state"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// State returns the lifecycle state of the service, pending for a service
+// not tracked by the bridge yet.
+func (s *Service) State() State {
+	if len(s.history) == 0 {
+		return StatePending
+	}
+	return s.history[len(s.history)-1].State
+}
+
+// Since returns when the service entered its current state.
+func (s *Service) Since() time.Time {
+	if len(s.history) == 0 {
+		return time.Time{}
+	}
+	return s.history[len(s.history)-1].Time
+}
+
+// History returns the recent state transitions of the service, oldest first.
+func (s *Service) History() []Transition {
+	return append([]Transition{}, s.history...)
+}
+
+// transition moves the service to state, and keeps the status attributes
+// backends see in line with it: draining and failed services carry the
+// "draining" and "failing" attributes until they are registered again. It
+// reports whether the transition is allowed; invalid ones are logged and
+// ignored.
+func (s *Service) transition(state State, reason string) bool {
+	current := s.State()
+	if current == state && len(s.history) > 0 {
+		return true
+	}
+	allowed := len(s.history) == 0 && state == StatePending
+	for _, next := range transitions[current] {
+		if next == state {
+			allowed = true
+		}
+	}
+	if !allowed {
+		log.Printf("invalid transition of %s from %s to %s (%s)", s.ID, current, state, reason)
+		return false
+	}
+
+	if s.Attrs == nil {
+		s.Attrs = make(map[string]string)
+	}
+	switch state {
+	case StateRegistered:
+		delete(s.Attrs, "draining")
+		delete(s.Attrs, "failing")
+	case StateDraining:
+		delete(s.Attrs, "failing")
+		s.Attrs["draining"] = "true"
+	case StateFailed:
+		delete(s.Attrs, "draining")
+		s.Attrs["failing"] = reason
+	}
+
+	s.history = append(s.history, Transition{State: state, Time: time.Now(), Reason: reason})
+	if len(s.history) > maxTransitions {
+		s.history = s.history[len(s.history)-maxTransitions:]
+	}
+	return true
+}
+
+// inRegistry reports whether the service is written to the registry.
+func (s *Service) inRegistry() bool {
+	switch s.State() {
+	case StateRegistered, StateDraining, StateFailed, StateDead:
+		return true
+	}
+	return false
+}
+
+// live reports whether the service belongs to a running container.
+func (s *Service) live() bool {
+	switch s.State() {
+	case StatePending, StateRegistering, StateRegistered, StateDraining:
+		return true
+	}
+	return false
+}
+
+// live returns whether a container has services that are live.
+func (b *Bridge) live(containerId string) bool {
+	for _, service := range b.services[containerId] {
+		if service.live() {
+			return true
+		}
+	}
+	return false
+}
+
+// isDraining returns whether a container has draining services.
+func (b *Bridge) isDraining(containerId string) bool {
+	for _, service := range b.services[containerId] {
+		if service.State() == StateDraining {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFailed returns whether a container has failed services.
+func (b *Bridge) hasFailed(containerId string) bool {
+	for _, service := range b.services[containerId] {
+		if service.State() == StateFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// expired reports whether a dead or failed service outlived its TTL, after
+// which the registry drops it as it is no longer refreshed.
+func (b *Bridge) expired(service *Service, now time.Time) bool {
+	switch service.State() {
+	case StateDead, StateFailed:
+		return service.TTL > 0 && now.Sub(service.Since()) >= time.Duration(service.TTL)*time.Second
+	}
+	return false
+}
+
+// ServiceStatus is the lifecycle of a service reported by the control
+// endpoint.
+type ServiceStatus struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Container string       `json:"container"`
+	State     State        `json:"state"`
+	Since     time.Time    `json:"since"`
+	History   []Transition `json:"history"`
+}
+
+// ServiceStates returns the lifecycle of all tracked services, sorted by
+// service ID.
+func (b *Bridge) ServiceStates() []ServiceStatus {
+	b.Lock()
+	defer b.Unlock()
+
+	var states []ServiceStatus
+	for containerId, services := range b.services {
+		for _, service := range services {
+			states = append(states, ServiceStatus{
+				ID:        service.ID,
+				Name:      service.Name,
+				Container: containerId,
+				State:     service.State(),
+				Since:     service.Since(),
+				History:   service.History(),
+			})
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].ID < states[j].ID
+	})
+	return states
+}
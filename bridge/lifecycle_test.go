@@ -0,0 +1,105 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransitions(t *testing.T) {
+	service := &Service{ID: "web"}
+	assert.Equal(t, StatePending, service.State())
+	assert.True(t, service.transition(StatePending, "discovered"))
+	assert.False(t, service.transition(StateDraining, "too early"))
+	assert.True(t, service.transition(StateRegistering, ""))
+	assert.True(t, service.transition(StateRegistered, ""))
+
+	assert.True(t, service.transition(StateDraining, "draining"))
+	assert.Equal(t, "true", service.Attrs["draining"])
+	assert.True(t, service.transition(StateFailed, "exit code 1"))
+	assert.Equal(t, "exit code 1", service.Attrs["failing"])
+	assert.NotContains(t, service.Attrs, "draining")
+	assert.True(t, service.transition(StateRegistered, "container started"))
+	assert.Empty(t, service.Attrs)
+
+	assert.True(t, service.transition(StateDeregistered, "removed"))
+	assert.False(t, service.transition(StateRegistered, "too late"))
+	assert.Equal(t, StateDeregistered, service.State())
+
+	var states []State
+	for _, transition := range service.History() {
+		states = append(states, transition.State)
+	}
+	assert.Equal(t, []State{StatePending, StateRegistering, StateRegistered, StateDraining,
+		StateFailed, StateRegistered, StateDeregistered}, states)
+	assert.Equal(t, "removed", service.History()[6].Reason)
+}
+
+func TestHistoryBounded(t *testing.T) {
+	services := markRegistered([]*Service{{ID: "web"}})
+	for i := 0; i < maxTransitions; i++ {
+		services[0].transition(StateDraining, "draining")
+		services[0].transition(StateRegistered, "restored")
+	}
+	history := services[0].History()
+	assert.Len(t, history, maxTransitions)
+	assert.Equal(t, StateRegistered, history[len(history)-1].State)
+}
+
+func TestRegisterFailureRetriedOnSync(t *testing.T) {
+	b := testBridge(t, Config{})
+	registry := &recordingAdapter{registerErr: errors.New("unavailable")}
+	b.registry = registry
+	container := testContainer(nil, "80/tcp")
+	container.State.Running = true
+	b.docker = &fakeDocker{containers: map[string]*dockerapi.Container{container.ID: container}}
+
+	b.Add(container.ID)
+	service := b.services[container.ID][0]
+	assert.Equal(t, StatePending, service.State())
+	assert.Equal(t, "register failed: unavailable", service.History()[len(service.History())-1].Reason)
+
+	registry.mu.Lock()
+	registry.registerErr = nil
+	registry.mu.Unlock()
+	b.Sync(true)
+	assert.Equal(t, StateRegistered, service.State())
+	assert.Equal(t, []string{"register " + service.ID, "register " + service.ID}, registry.Calls())
+	assert.Len(t, b.services[container.ID], 1)
+}
+
+func TestDeadServicesExpire(t *testing.T) {
+	container := testContainer(nil, "80/tcp")
+	b, registry := registeredBridge(t, container)
+	b.config.RefreshTtl = 60
+	service := b.services[container.ID][0]
+	service.TTL = 60
+
+	b.remove(container.ID, false)
+	assert.Equal(t, StateDead, service.State())
+	b.Refresh()
+	assert.Empty(t, registry.Calls())
+	assert.Len(t, b.services[container.ID], 1)
+
+	service.history[len(service.history)-1].Time = time.Now().Add(-time.Minute)
+	b.Refresh()
+	assert.Equal(t, StateDeregistered, service.State())
+	assert.Empty(t, b.services)
+	assert.Empty(t, registry.Calls())
+}
+
+func TestServiceStates(t *testing.T) {
+	container := testContainer([]string{"SERVICE_DRAIN=1m"}, "80/tcp")
+	b, _ := registeredBridge(t, container)
+	b.Drain(container.ID)
+	defer b.remove(container.ID, true)
+
+	states := b.ServiceStates()
+	assert.Len(t, states, 1)
+	assert.Equal(t, container.ID, states[0].Container)
+	assert.Equal(t, StateDraining, states[0].State)
+	assert.Equal(t, "draining for 1m0s", states[0].History[len(states[0].History)-1].Reason)
+}
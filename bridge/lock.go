@@ -0,0 +1,78 @@
+package bridge
+
+import "sync"
+
+// registryConcurrency bounds the containers whose services a sync or refresh
+// writes to the registry at once.
+const registryConcurrency = 8
+
+// containerLocks serializes the operations on each container, so that the
+// registry sees them in order, while different containers proceed in
+// parallel. An operation holds the lock of its container across Docker and
+// registry calls, and the bridge lock only while it reads or changes state.
+// Locks are always taken in that order: container, then bridge.
+type containerLocks struct {
+	mu    sync.Mutex
+	locks map[string]*containerLock
+}
+
+type containerLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks a container, and returns the function that unlocks it.
+func (l *containerLocks) lock(containerId string) func() {
+	unlock, _ := l.acquire(containerId, true)
+	return unlock
+}
+
+// tryLock locks a container unless an operation on it is in progress or
+// waiting, in which case it reports false.
+func (l *containerLocks) tryLock(containerId string) (func(), bool) {
+	return l.acquire(containerId, false)
+}
+
+func (l *containerLocks) acquire(containerId string, wait bool) (func(), bool) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*containerLock)
+	}
+	cl := l.locks[containerId]
+	if cl != nil && !wait {
+		l.mu.Unlock()
+		return nil, false
+	}
+	if cl == nil {
+		cl = new(containerLock)
+		l.locks[containerId] = cl
+	}
+	cl.refs++
+	l.mu.Unlock()
+
+	cl.Lock()
+	return func() {
+		cl.Unlock()
+		l.mu.Lock()
+		cl.refs--
+		if cl.refs == 0 {
+			delete(l.locks, containerId)
+		}
+		l.mu.Unlock()
+	}, true
+}
+
+// parallel calls fn for each container, at most limit at a time.
+func parallel(containerIds []string, limit int, fn func(containerId string)) {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for _, containerId := range containerIds {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(containerId string) {
+			defer func() { <-sem; wg.Done() }()
+			fn(containerId)
+		}(containerId)
+	}
+	wg.Wait()
+}
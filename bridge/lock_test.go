@@ -0,0 +1,162 @@
+package bridge
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainerLocks(t *testing.T) {
+	var locks containerLocks
+	unlock := locks.lock("a")
+
+	done := make(chan bool)
+	go func() {
+		locks.lock("b")()
+		done <- true
+	}()
+	assert.True(t, <-done, "other containers aren't blocked")
+	_, ok := locks.tryLock("a")
+	assert.False(t, ok)
+
+	locked := make(chan bool)
+	go func() {
+		unlock := locks.lock("a")
+		locked <- true
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("same container locked twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+	assert.Eventually(t, func() bool {
+		locks.mu.Lock()
+		defer locks.mu.Unlock()
+		return len(locks.locks) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// blockingAdapter holds the registration of one service until released.
+type blockingAdapter struct {
+	recordingAdapter
+	block   string
+	release chan struct{}
+}
+
+func (a *blockingAdapter) Register(service *Service) error {
+	if service.ID == a.block {
+		<-a.release
+	}
+	return a.recordingAdapter.Register(service)
+}
+
+func numberedContainers(n int) map[string]*dockerapi.Container {
+	containers := make(map[string]*dockerapi.Container, n)
+	for i := 0; i < n; i++ {
+		container := testContainer(nil, "80/tcp")
+		container.ID = fmt.Sprintf("%032d", i)
+		container.Name = fmt.Sprintf("/web.%d", i)
+		// distinct host ports, as containers sharing one would conflict
+		container.NetworkSettings.Ports["80/tcp"][0].HostPort = strconv.Itoa(32768 + i)
+		container.State.Running = true
+		containers[container.ID] = container
+	}
+	return containers
+}
+
+func TestSlowRegistryDoesNotBlock(t *testing.T) {
+	b := testBridge(t, Config{})
+	containers := numberedContainers(2)
+	b.docker = &fakeDocker{containers: containers}
+	registry := &blockingAdapter{block: Hostname + ":web.0:80", release: make(chan struct{})}
+	b.registry = registry
+
+	slow := make(chan bool)
+	go func() {
+		b.Add(fmt.Sprintf("%032d", 0))
+		slow <- true
+	}()
+	assert.Eventually(t, func() bool {
+		states := b.ServiceStates()
+		return len(states) == 1 && states[0].State == StateRegistering
+	}, time.Second, 10*time.Millisecond)
+
+	b.Add(fmt.Sprintf("%032d", 1))
+	b.Refresh()
+	b.Sync(true)
+	for _, call := range registry.Calls() {
+		assert.NotContains(t, call, ":web.0:")
+	}
+	assert.Contains(t, registry.Calls(), "register "+Hostname+":web.1:80")
+
+	close(registry.release)
+	<-slow
+	for _, state := range b.ServiceStates() {
+		assert.Equal(t, StateRegistered, state.State)
+	}
+}
+
+func TestConcurrentOperations(t *testing.T) {
+	b := testBridge(t, Config{RefreshTtl: 60, RefreshInterval: 30, Cleanup: true})
+	containers := numberedContainers(16)
+	b.docker = &fakeDocker{containers: containers}
+	registry := new(recordingAdapter)
+	b.registry = registry
+
+	var wg sync.WaitGroup
+	for containerId := range containers {
+		for _, op := range []func(string){b.Add, b.Update, b.Drain, b.Remove, b.Add} {
+			wg.Add(1)
+			go func(op func(string), containerId string) {
+				defer wg.Done()
+				op(containerId)
+			}(op, containerId)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		enabled := i%2 == 0
+		wg.Add(4)
+		go func() { defer wg.Done(); b.Refresh() }()
+		go func() { defer wg.Done(); b.Sync(true) }()
+		go func() { defer wg.Done(); b.ServiceStates() }()
+		go func() { defer wg.Done(); b.SetHostMaintenance(enabled, "test") }()
+	}
+	wg.Wait()
+
+	// whatever the interleaving, the state is consistent once settled
+	b.SetHostMaintenance(false, "")
+	for containerId := range containers {
+		b.Add(containerId)
+	}
+	b.Sync(true)
+	states := b.ServiceStates()
+	assert.Len(t, states, len(containers))
+	for _, state := range states {
+		assert.Equal(t, StateRegistered, state.State, state.ID)
+	}
+
+	for containerId := range containers {
+		b.Remove(containerId)
+	}
+	assert.Empty(t, b.ServiceStates())
+	last := make(map[string]string)
+	for _, call := range registry.Calls() {
+		var method, id string
+		fmt.Sscan(call, &method, &id)
+		if method == "register" || method == "deregister" {
+			last[id] = method
+		}
+	}
+	assert.Len(t, last, len(containers))
+	for id, method := range last {
+		assert.Equal(t, "deregister", method, id)
+	}
+}
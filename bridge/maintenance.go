@@ -0,0 +1,195 @@
+package bridge
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+// MaintenanceMode is a maintenance setting of the host, a container or a
+// service.
+type MaintenanceMode struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// attr is the value of the "maintenance" attribute while enabled.
+func (m MaintenanceMode) attr() string {
+	if m.Reason != "" {
+		return m.Reason
+	}
+	return "true"
+}
+
+// SetHostMaintenance takes all services of the host out of rotation, or puts
+// them back, unless they are in maintenance on their own.
+func (b *Bridge) SetHostMaintenance(enabled bool, reason string) {
+	b.Lock()
+	log.Println("host maintenance:", onOff(enabled))
+	b.hostMaintenance = MaintenanceMode{Enabled: enabled, Reason: reason}
+	b.Unlock()
+	b.updateMaintenance()
+}
+
+// SetContainerMaintenance sets maintenance mode for the services of a
+// container, given by ID, ID prefix or name. This overrides the container's
+// SERVICE_MAINTENANCE metadata.
+func (b *Bridge) SetContainerMaintenance(container string, enabled bool, reason string) error {
+	b.Lock()
+	containerId := b.findContainer(container)
+	if containerId == "" {
+		b.Unlock()
+		return errors.New("no services for container " + container)
+	}
+	log.Println("container maintenance:", containerId[:12], onOff(enabled))
+	b.containerMaintenance[containerId] = MaintenanceMode{Enabled: enabled, Reason: reason}
+	b.Unlock()
+	b.updateMaintenance()
+	return nil
+}
+
+// SetServiceMaintenance sets maintenance mode for a single service.
+func (b *Bridge) SetServiceMaintenance(serviceId string, enabled bool, reason string) error {
+	if !b.tracked(serviceId) {
+		return errors.New("no service " + serviceId)
+	}
+	b.Lock()
+	log.Println("service maintenance:", serviceId, onOff(enabled))
+	b.serviceMaintenance[serviceId] = MaintenanceMode{Enabled: enabled, Reason: reason}
+	b.Unlock()
+	b.updateMaintenance()
+	return nil
+}
+
+// findContainer returns the ID of the container with services known by ID,
+// unique ID prefix or name.
+func (b *Bridge) findContainer(container string) string {
+	var found string
+	for containerId, services := range b.services {
+		if containerId == container {
+			return containerId
+		}
+		name := ""
+		if len(services) > 0 && services[0].Origin.container != nil {
+			name = strings.TrimPrefix(services[0].Origin.container.Name, "/")
+		}
+		if name == container || strings.HasPrefix(containerId, container) {
+			if found != "" {
+				// ambiguous prefix
+				return ""
+			}
+			found = containerId
+		}
+	}
+	return found
+}
+
+// maintenance returns the maintenance mode of a service: the host's when
+// enabled, else the service's own, the container's, or the SERVICE_MAINTENANCE
+// metadata of the container.
+func (b *Bridge) maintenance(containerId string, service *Service) MaintenanceMode {
+	if b.hostMaintenance.Enabled {
+		return b.hostMaintenance
+	}
+	if m, ok := b.serviceMaintenance[service.ID]; ok {
+		return m
+	}
+	if m, ok := b.containerMaintenance[containerId]; ok {
+		return m
+	}
+	if service.Origin.container == nil {
+		return MaintenanceMode{}
+	}
+	port := service.Origin
+	metadata, _ := serviceMetaData(port.container.Config, port.ExposedPort+"/"+port.PortType, b.config.MetadataPrefixes)
+	switch value := mapDefault(metadata, "maintenance", ""); strings.ToLower(value) {
+	case "", "false", "0", "no":
+		return MaintenanceMode{}
+	case "true", "1", "yes":
+		return MaintenanceMode{Enabled: true}
+	default:
+		return MaintenanceMode{Enabled: true, Reason: value}
+	}
+}
+
+// applyMaintenance sets the "maintenance" attribute of a service, and
+// reports whether it changed.
+func (b *Bridge) applyMaintenance(containerId string, service *Service) bool {
+	m := b.maintenance(containerId, service)
+	current := service.Attrs["maintenance"]
+	switch {
+	case m.Enabled && current != m.attr():
+		service.Attrs["maintenance"] = m.attr()
+		return true
+	case !m.Enabled && current != "":
+		delete(service.Attrs, "maintenance")
+		return true
+	}
+	return false
+}
+
+// updateMaintenance applies the maintenance settings to all services. The
+// caller doesn't hold the bridge lock.
+func (b *Bridge) updateMaintenance() {
+	for _, containerId := range b.containerIds() {
+		unlock := b.containers.lock(containerId)
+		var changed []*Service
+		b.Lock()
+		for _, service := range b.services[containerId] {
+			if b.applyMaintenance(containerId, service) && service.inRegistry() {
+				changed = append(changed, service)
+			}
+		}
+		b.Unlock()
+		for _, service := range changed {
+			b.updateStatus(service)
+		}
+		unlock()
+	}
+}
+
+// forgetMaintenance drops the maintenance settings of a removed container.
+func (b *Bridge) forgetMaintenance(containerId string, services []*Service) {
+	delete(b.containerMaintenance, containerId)
+	for _, service := range services {
+		delete(b.serviceMaintenance, service.ID)
+	}
+}
+
+// MaintenanceStatus is the maintenance state reported by the control endpoint.
+type MaintenanceStatus struct {
+	Host       MaintenanceMode            `json:"host"`
+	Containers map[string]MaintenanceMode `json:"containers"`
+	Services   map[string]MaintenanceMode `json:"services"`
+}
+
+// Maintenance returns the explicit maintenance settings, and the services
+// currently in maintenance.
+func (b *Bridge) Maintenance() MaintenanceStatus {
+	b.Lock()
+	defer b.Unlock()
+
+	status := MaintenanceStatus{
+		Host:       b.hostMaintenance,
+		Containers: make(map[string]MaintenanceMode),
+		Services:   make(map[string]MaintenanceMode),
+	}
+	for containerId, m := range b.containerMaintenance {
+		status.Containers[containerId] = m
+	}
+	for containerId, services := range b.services {
+		for _, service := range services {
+			if m := b.maintenance(containerId, service); m.Enabled {
+				status.Services[service.ID] = m
+			}
+		}
+	}
+	return status
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,80 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenance(t *testing.T) {
+	container := testContainer(nil, "80/tcp")
+	b, registry := registeredBridge(t, container)
+	service := b.services[container.ID][0]
+
+	b.SetHostMaintenance(true, "")
+	assert.Equal(t, "maintenance", service.Status())
+	assert.Equal(t, "true", service.Attrs["maintenance"])
+
+	// explicit settings of the container don't matter while the host is in maintenance
+	assert.NoError(t, b.SetContainerMaintenance("web.0", false, ""))
+	assert.Equal(t, "maintenance", service.Status())
+
+	b.SetHostMaintenance(false, "")
+	assert.Equal(t, "", service.Status())
+
+	assert.NoError(t, b.SetServiceMaintenance(service.ID, true, "upgrade"))
+	assert.Equal(t, "upgrade", service.Attrs["maintenance"])
+	assert.Error(t, b.SetServiceMaintenance("nope", true, ""))
+	assert.Error(t, b.SetContainerMaintenance("nope", true, ""))
+
+	assert.Equal(t, []string{
+		"status:maintenance " + service.ID,
+		"status: " + service.ID,
+		"status:maintenance " + service.ID,
+	}, registry.Calls())
+}
+
+func TestMaintenanceLabel(t *testing.T) {
+	container := testContainer([]string{"SERVICE_80_MAINTENANCE=true"}, "80/tcp")
+	b, _ := registeredBridge(t, container)
+	service := b.services[container.ID][0]
+	assert.Equal(t, "", service.Attrs["maintenance"])
+
+	assert.True(t, b.applyMaintenance(container.ID, service))
+	assert.Equal(t, "maintenance", service.Status())
+
+	assert.NoError(t, b.SetContainerMaintenance(container.ID[:6], false, ""))
+	assert.Equal(t, "", service.Status())
+}
+
+func TestControlHandler(t *testing.T) {
+	container := testContainer(nil, "80/tcp")
+	b, _ := registeredBridge(t, container)
+	service := b.services[container.ID][0]
+	handler := b.ControlHandler()
+
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve("PUT", "/maintenance/containers/web.0?reason=deploy").Code)
+	assert.Equal(t, "deploy", service.Attrs["maintenance"])
+	assert.Equal(t, http.StatusNotFound, serve("PUT", "/maintenance/containers/db.0").Code)
+	assert.Equal(t, http.StatusNotFound, serve("PUT", "/maintenance/hosts/x").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve("PATCH", "/maintenance").Code)
+
+	w := serve("GET", "/maintenance")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var status MaintenanceStatus
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.False(t, status.Host.Enabled)
+	assert.Equal(t, MaintenanceMode{Enabled: true, Reason: "deploy"}, status.Services[service.ID])
+
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/maintenance/services/"+service.ID).Code)
+	assert.Equal(t, "", service.Status())
+}
@@ -0,0 +1,177 @@
+package bridge
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// Sources of the node ID, besides a literal one.
+const (
+	NodeIDDockerName = "@docker-name"
+	NodeIDDockerID   = "@docker-id"
+)
+
+// Owner identifies the Registrator that registered a service: the node ID of
+// its host, the container the service belongs to, and the Registrator process,
+// which changes on every restart.
+type Owner struct {
+	Node      string `json:"node"`
+	Container string `json:"container"`
+	Instance  string `json:"instance"`
+}
+
+// Keys of the owner in service metadata, for backends that store it as
+// key-value pairs, like Consul.
+const (
+	OwnerNodeMeta      = "registrator_node"
+	OwnerContainerMeta = "registrator_container"
+	OwnerInstanceMeta  = "registrator_instance"
+)
+
+// Meta returns the owner as service metadata.
+func (o *Owner) Meta() map[string]string {
+	return map[string]string{
+		OwnerNodeMeta:      o.Node,
+		OwnerContainerMeta: o.Container,
+		OwnerInstanceMeta:  o.Instance,
+	}
+}
+
+// OwnerFromMeta returns the owner stored in service metadata, or nil if the
+// service wasn't registered with one.
+func OwnerFromMeta(meta map[string]string) *Owner {
+	if meta[OwnerNodeMeta] == "" {
+		return nil
+	}
+	return &Owner{
+		Node:      meta[OwnerNodeMeta],
+		Container: meta[OwnerContainerMeta],
+		Instance:  meta[OwnerInstanceMeta],
+	}
+}
+
+// newInstanceID returns a random ID for this Registrator process.
+func newInstanceID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// dockerInfo is the part of the Docker API the node ID is resolved with.
+type dockerInfo interface {
+	Info() (*dockerapi.DockerInfo, error)
+}
+
+// ResolveNodeID returns the identity of this host in service IDs and
+// ownership: nodeID as given, or the name or ID of the Docker daemon for
+// "@docker-name" and "@docker-id". Without nodeID, it is the hostname. With a
+// file, the node ID stays the one stored in it, unless given literally, and is
+// stored there if the file doesn't exist yet, so that it survives the
+// Registrator container being recreated with another hostname.
+func ResolveNodeID(docker dockerInfo, nodeID, file string) (string, error) {
+	nodeID = strings.TrimSpace(nodeID)
+	literal := nodeID != "" && !strings.HasPrefix(nodeID, "@")
+	if file != "" && !literal {
+		data, err := ioutil.ReadFile(file)
+		switch {
+		case err == nil:
+			stored := strings.TrimSpace(string(data))
+			if err := validNodeID(stored); err != nil {
+				return "", errors.New(file + ": " + err.Error())
+			}
+			return stored, nil
+		case !os.IsNotExist(err):
+			return "", err
+		}
+	}
+
+	switch nodeID {
+	case NodeIDDockerName, NodeIDDockerID:
+		info, err := docker.Info()
+		if err != nil {
+			return "", err
+		}
+		if nodeID == NodeIDDockerID {
+			nodeID = info.ID
+		} else {
+			nodeID = info.Name
+		}
+		// older daemons have IDs like "7TRN:IPZB:QYBB:..."
+		nodeID = strings.Replace(nodeID, ":", "-", -1)
+	case "":
+		if Hostname == "" {
+			return "", errors.New("unable to determine the hostname for the node ID, set one with -node-id")
+		}
+		nodeID = Hostname
+	}
+	if err := validNodeID(nodeID); err != nil {
+		return "", err
+	}
+
+	if file != "" {
+		if data, err := ioutil.ReadFile(file); err == nil && strings.TrimSpace(string(data)) == nodeID {
+			return nodeID, nil
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(file, []byte(nodeID+"\n"), 0644); err != nil {
+			return "", err
+		}
+		log.Println("stored node ID in", file)
+	}
+	return nodeID, nil
+}
+
+func validNodeID(nodeID string) error {
+	switch {
+	case nodeID == "":
+		return errors.New("empty node ID")
+	case strings.ContainsAny(nodeID, ": /\t\n"):
+		return errors.New("node ID " + nodeID + " contains ':', '/' or whitespace")
+	case strings.HasPrefix(nodeID, "@"):
+		return errors.New("unknown node ID source " + nodeID + ", expected " + NodeIDDockerName + " or " + NodeIDDockerID)
+	}
+	return nil
+}
+
+// nodeID returns the identity of this host, which prefixes the IDs of its
+// services.
+func (b *Bridge) nodeID() string {
+	if b.config.NodeID != "" {
+		return b.config.NodeID
+	}
+	return Hostname
+}
+
+// owner returns the owner a service of a container is registered with.
+func (b *Bridge) owner(containerId string) *Owner {
+	return &Owner{Node: b.nodeID(), Container: containerId, Instance: b.instance}
+}
+
+// owned reports whether a registered service belongs to this host, by its
+// owner. Services registered without one, by older releases or backends that
+// don't store it, are only recognized by the node their ID was generated on
+// with -cleanup-legacy, as other tools may use IDs of the same shape.
+func (b *Bridge) owned(service *Service) bool {
+	if service.Owner != nil {
+		return service.Owner.Node == b.nodeID()
+	}
+	if !b.config.CleanupLegacy {
+		return false
+	}
+	id, ok := parseServiceID(service.ID)
+	return ok && id.Hostname == b.nodeID()
+}
@@ -0,0 +1,123 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeInfo dockerapi.DockerInfo
+
+func (f *fakeInfo) Info() (*dockerapi.DockerInfo, error) {
+	return (*dockerapi.DockerInfo)(f), nil
+}
+
+func TestResolveNodeID(t *testing.T) {
+	docker := &fakeInfo{Name: "docker-host-1", ID: "7TRN:IPZB:QYBB"}
+	for nodeID, expected := range map[string]string{
+		"":               Hostname,
+		"node-a":         "node-a",
+		NodeIDDockerName: "docker-host-1",
+		NodeIDDockerID:   "7TRN-IPZB-QYBB",
+		" node-b\n":      "node-b",
+	} {
+		resolved, err := ResolveNodeID(docker, nodeID, "")
+		assert.NoError(t, err, nodeID)
+		assert.Equal(t, expected, resolved, nodeID)
+	}
+	for _, nodeID := range []string{"a:b", "a b", "@docker"} {
+		_, err := ResolveNodeID(docker, nodeID, "")
+		assert.Error(t, err, nodeID)
+	}
+
+	defer func(hostname string) { Hostname = hostname }(Hostname)
+	Hostname = ""
+	_, err := ResolveNodeID(docker, "", "")
+	assert.Contains(t, err.Error(), "-node-id")
+	resolved, err := ResolveNodeID(docker, NodeIDDockerName, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "docker-host-1", resolved)
+}
+
+func TestResolveNodeIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registrator")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state", "node-id")
+	docker := &fakeInfo{Name: "docker-host-1"}
+
+	nodeID, err := ResolveNodeID(docker, NodeIDDockerName, file)
+	assert.NoError(t, err)
+	assert.Equal(t, "docker-host-1", nodeID)
+	data, _ := ioutil.ReadFile(file)
+	assert.Equal(t, "docker-host-1\n", string(data))
+
+	// the stored ID sticks when the daemon or hostname change
+	docker.Name = "docker-host-2"
+	nodeID, err = ResolveNodeID(docker, NodeIDDockerName, file)
+	assert.NoError(t, err)
+	assert.Equal(t, "docker-host-1", nodeID)
+	nodeID, err = ResolveNodeID(docker, "", file)
+	assert.NoError(t, err)
+	assert.Equal(t, "docker-host-1", nodeID)
+
+	// unless it is given literally
+	nodeID, err = ResolveNodeID(docker, "node-a", file)
+	assert.NoError(t, err)
+	assert.Equal(t, "node-a", nodeID)
+	data, _ = ioutil.ReadFile(file)
+	assert.Equal(t, "node-a\n", string(data))
+}
+
+func TestNodeIDOwnership(t *testing.T) {
+	b := testBridge(t, Config{NodeID: "node-a"})
+	container := testContainer(nil, "80/tcp")
+	port := servicePort(container, "80/tcp", container.NetworkSettings.Ports["80/tcp"])
+	service := b.newService(port, false, nil)[0]
+	assert.Equal(t, "node-a:web.0:80", service.ID)
+
+	b.registry = new(recordingAdapter)
+	assert.True(t, b.register(container.ID, service))
+	assert.Equal(t, &Owner{Node: "node-a", Container: container.ID, Instance: b.instance}, service.Owner)
+
+	assert.False(t, b.owned(&Service{ID: "node-a:web.1:80"}))
+	b.config.CleanupLegacy = true
+	assert.True(t, b.owned(&Service{ID: "node-a:web.1:80"}))
+	assert.False(t, b.owned(&Service{ID: Hostname + ":web.1:80"}))
+	assert.True(t, b.owned(&Service{ID: "custom", Owner: &Owner{Node: "node-a"}}))
+	assert.False(t, b.owned(&Service{ID: "node-a:web.1:80", Owner: &Owner{Node: "node-b"}}))
+}
+
+func TestOwnerMeta(t *testing.T) {
+	owner := &Owner{Node: "node-a", Container: "abc", Instance: "123"}
+	assert.Equal(t, owner, OwnerFromMeta(owner.Meta()))
+	assert.Nil(t, OwnerFromMeta(map[string]string{"version": "1"}))
+}
+
+func TestCleanupByOwner(t *testing.T) {
+	b, registry := danglingBridge(t, Config{NodeID: "node-a"}, 0)
+	registry.registered = []*Service{
+		// SERVICE_ID set, only recognizable by its owner
+		{ID: "custom", Name: "web", Owner: &Owner{Node: "node-a", Container: "gone"}},
+		// shaped like a service ID of this host, but registered by another
+		{ID: "node-a:web:80", Name: "web", Owner: &Owner{Node: "node-b"}},
+		// registered without an owner
+		{ID: "node-a:web.1:80", Name: "web"},
+		{ID: "other", Name: "web"},
+	}
+
+	b.Sync(true)
+	b.Sync(true)
+	assert.Equal(t, []string{"deregister custom"}, registry.Calls())
+
+	// services of older releases are recognized by their ID once opted in
+	registry.registered = registry.registered[1:]
+	b.config.CleanupLegacy = true
+	b.Sync(true)
+	b.Sync(true)
+	assert.Equal(t, []string{"deregister custom", "deregister node-a:web.1:80"}, registry.Calls())
+}
@@ -0,0 +1,212 @@
+package bridge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// Outcomes of a deregistration policy for the services of an exited container.
+const (
+	// OutcomeDeregister removes the services from the registry.
+	OutcomeDeregister = "deregister"
+	// OutcomeKeep leaves the services registered.
+	OutcomeKeep = "keep"
+	// OutcomeFail leaves the services registered, but marks them failing,
+	// see RegistryAdapter.UpdateStatus.
+	OutcomeFail = "fail"
+)
+
+// maxExits bounds the number of exits remembered per container for the
+// restarts condition.
+const maxExits = 32
+
+// deregisterPolicy is an ordered list of rules, the first matching rule
+// decides the outcome. When no rule matches, services are deregistered.
+type deregisterPolicy []policyRule
+
+type policyRule struct {
+	text      string
+	condition string
+	codes     [][2]int      // exit: inclusive ranges of exit codes
+	restarts  int           // restarts: minimum number of exits...
+	window    time.Duration // ...within this window
+	outcome   string
+}
+
+// exitInfo describes the exit of a container a policy decides about.
+type exitInfo struct {
+	container *dockerapi.Container
+	// stopped is set when the container was sent a stop signal, in which
+	// case Docker doesn't restart it
+	stopped bool
+	// exits are the times the container exited recently, latest last
+	exits []time.Time
+	now   time.Time
+}
+
+// parseDeregisterPolicy parses a comma-separated list of <condition>=<outcome>
+// rules, or one of the shorthands "always" and "on-success". Conditions are:
+//
+//	any             every exit
+//	success         exit code 0, or an exit caused by a signal
+//	failure         any other exit
+//	signaled        an exit caused by a signal
+//	oom             the container was killed for running out of memory
+//	restarting      Docker will restart the container per its restart policy
+//	exit:<codes>    exit codes separated by "|", or ranges, e.g. exit:1|126-127
+//	restarts:<n>/<window>  the container exited at least n times within window, e.g. restarts:3/10m
+func parseDeregisterPolicy(s string) (deregisterPolicy, error) {
+	switch strings.TrimSpace(s) {
+	case "", "always":
+		s = "any=deregister"
+	case "on-success":
+		s = "success=deregister,any=keep"
+	}
+
+	var policy deregisterPolicy
+	for _, text := range strings.Split(s, ",") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		rule, err := parsePolicyRule(text)
+		if err != nil {
+			return nil, err
+		}
+		policy = append(policy, rule)
+	}
+	if len(policy) == 0 {
+		return nil, fmt.Errorf("deregister policy %q has no rules", s)
+	}
+	return policy, nil
+}
+
+func parsePolicyRule(text string) (policyRule, error) {
+	rule := policyRule{text: text}
+	i := strings.LastIndex(text, "=")
+	if i < 0 {
+		return rule, fmt.Errorf("deregister rule %q: expected <condition>=<outcome>", text)
+	}
+	rule.condition, rule.outcome = text[:i], text[i+1:]
+	switch rule.outcome {
+	case OutcomeDeregister, OutcomeKeep, OutcomeFail:
+	default:
+		return rule, fmt.Errorf("deregister rule %q: outcome must be deregister, keep or fail", text)
+	}
+
+	name, arg := rule.condition, ""
+	if j := strings.Index(name, ":"); j >= 0 {
+		name, arg = name[:j], name[j+1:]
+	}
+	switch name {
+	case "any", "success", "failure", "signaled", "oom", "restarting":
+		if arg != "" {
+			return rule, fmt.Errorf("deregister rule %q: %s takes no argument", text, name)
+		}
+	case "exit":
+		for _, code := range strings.Split(arg, "|") {
+			bounds := strings.SplitN(code, "-", 2)
+			from, err := strconv.Atoi(bounds[0])
+			to := from
+			if err == nil && len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+			}
+			if err != nil || from > to {
+				return rule, fmt.Errorf("deregister rule %q: invalid exit code %q", text, code)
+			}
+			rule.codes = append(rule.codes, [2]int{from, to})
+		}
+	case "restarts":
+		parts := strings.SplitN(arg, "/", 2)
+		n, err := strconv.Atoi(parts[0])
+		if err != nil || n < 1 || len(parts) != 2 {
+			return rule, fmt.Errorf("deregister rule %q: expected restarts:<n>/<window>", text)
+		}
+		window, err := time.ParseDuration(parts[1])
+		if err != nil || window <= 0 {
+			return rule, fmt.Errorf("deregister rule %q: invalid window %q", text, parts[1])
+		}
+		rule.restarts, rule.window = n, window
+	default:
+		return rule, fmt.Errorf("deregister rule %q: unknown condition %q", text, name)
+	}
+	rule.condition = name
+	return rule, nil
+}
+
+// decide returns the outcome for an exit, and the rule that matched.
+func (p deregisterPolicy) decide(exit exitInfo) (string, string) {
+	for _, rule := range p {
+		if rule.matches(exit) {
+			return rule.outcome, rule.text
+		}
+	}
+	return OutcomeDeregister, "default"
+}
+
+// unconditional returns the outcome of a policy that doesn't depend on the
+// exit, as for "always".
+func (p deregisterPolicy) unconditional() (string, bool) {
+	if p[0].condition == "any" {
+		return p[0].outcome, true
+	}
+	return "", false
+}
+
+func (r policyRule) matches(exit exitInfo) bool {
+	state := exit.container.State
+	signaled := state.ExitCode&dockerSignaledBit == dockerSignaledBit
+	switch r.condition {
+	case "any":
+		return true
+	case "success":
+		return state.ExitCode == 0 || signaled
+	case "failure":
+		return state.ExitCode != 0 && !signaled
+	case "signaled":
+		return signaled
+	case "oom":
+		return state.OOMKilled
+	case "restarting":
+		return willRestart(exit.container, exit.stopped)
+	case "exit":
+		for _, codes := range r.codes {
+			if state.ExitCode >= codes[0] && state.ExitCode <= codes[1] {
+				return true
+			}
+		}
+		return false
+	case "restarts":
+		n := 0
+		for _, t := range exit.exits {
+			if exit.now.Sub(t) <= r.window {
+				n++
+			}
+		}
+		return n >= r.restarts
+	}
+	return false
+}
+
+// willRestart reports whether Docker restarts the container after this exit.
+func willRestart(container *dockerapi.Container, stopped bool) bool {
+	if container.State.Restarting {
+		return true
+	}
+	if stopped || container.HostConfig == nil {
+		return false
+	}
+	policy := container.HostConfig.RestartPolicy
+	switch policy.Name {
+	case "always", "unless-stopped":
+		return true
+	case "on-failure":
+		return container.State.ExitCode != 0 &&
+			(policy.MaximumRetryCount == 0 || container.RestartCount < policy.MaximumRetryCount)
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func exitedContainer(code int) *dockerapi.Container {
+	return &dockerapi.Container{
+		State:      dockerapi.State{ExitCode: code},
+		HostConfig: &dockerapi.HostConfig{},
+	}
+}
+
+func TestDeregisterPolicyShorthands(t *testing.T) {
+	always, err := parseDeregisterPolicy("always")
+	assert.NoError(t, err)
+	onSuccess, err := parseDeregisterPolicy("on-success")
+	assert.NoError(t, err)
+
+	for code, expected := range map[int]string{0: OutcomeDeregister, 1: OutcomeKeep, 143: OutcomeDeregister} {
+		outcome, _ := always.decide(exitInfo{container: exitedContainer(code)})
+		assert.Equal(t, OutcomeDeregister, outcome)
+		outcome, _ = onSuccess.decide(exitInfo{container: exitedContainer(code)})
+		assert.Equal(t, expected, outcome, "exit code %d", code)
+	}
+}
+
+func TestDeregisterPolicy(t *testing.T) {
+	policy, err := parseDeregisterPolicy("restarting=keep, oom=fail, exit:1|126-127=fail, restarts:3/10m=deregister, success=deregister, any=keep")
+	assert.NoError(t, err)
+
+	decide := func(container *dockerapi.Container, stopped bool, exits ...time.Time) string {
+		outcome, _ := policy.decide(exitInfo{container: container, stopped: stopped, exits: exits, now: time.Now()})
+		return outcome
+	}
+
+	restarting := exitedContainer(0)
+	restarting.HostConfig.RestartPolicy = dockerapi.AlwaysRestart()
+	assert.Equal(t, OutcomeKeep, decide(restarting, false))
+	assert.Equal(t, OutcomeDeregister, decide(restarting, true))
+
+	onFailure := exitedContainer(2)
+	onFailure.HostConfig.RestartPolicy = dockerapi.RestartOnFailure(3)
+	assert.Equal(t, OutcomeKeep, decide(onFailure, false))
+	onFailure.RestartCount = 3
+	now := time.Now()
+	assert.Equal(t, OutcomeDeregister, decide(onFailure, false, now.Add(-time.Hour), now.Add(-time.Minute), now.Add(-time.Second), now))
+	assert.Equal(t, OutcomeKeep, decide(onFailure, false, now.Add(-time.Hour), now.Add(-time.Second), now))
+
+	oom := exitedContainer(137)
+	oom.State.OOMKilled = true
+	assert.Equal(t, OutcomeFail, decide(oom, false))
+	assert.Equal(t, OutcomeFail, decide(exitedContainer(126), false))
+	assert.Equal(t, OutcomeDeregister, decide(exitedContainer(0), false))
+}
+
+func TestDeregisterPolicyErrors(t *testing.T) {
+	for _, text := range []string{
+		"sometimes",
+		"any=remove",
+		"exit:abc=keep",
+		"exit:5-1=keep",
+		"restarts:3=keep",
+		"restarts:3/never=keep",
+		"oom:yes=fail",
+		",",
+	} {
+		_, err := parseDeregisterPolicy(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestDeregisterFail(t *testing.T) {
+	container := testContainer([]string{"SERVICE_DEREGISTER=failure=fail,any=deregister"}, "80/tcp")
+	container.State.ExitCode = 3
+	b, registry := registeredBridge(t, container)
+	id := b.services[container.ID][0].ID
+
+	b.RemoveOnExit(container.ID)
+	assert.Equal(t, []string{"status:failing " + id}, registry.Calls())
+	failed := b.services[container.ID][0]
+	assert.Equal(t, StateFailed, failed.State())
+	assert.Equal(t, "exit code 3", failed.Attrs["failing"])
+
+	container.State.Running = true
+	b.Add(container.ID)
+	assert.Equal(t, "", b.services[container.ID][0].Status())
+	assert.Equal(t, []string{"status:failing " + id, "status: " + id}, registry.Calls())
+}
+
+func TestFailedRemovedContainer(t *testing.T) {
+	container := testContainer([]string{"SERVICE_DEREGISTER=failure=fail,any=deregister"}, "80/tcp")
+	container.State.ExitCode = 3
+	b, registry := registeredBridge(t, container)
+	b.config.Cleanup = true
+	id := b.services[container.ID][0].ID
+
+	b.RemoveOnExit(container.ID)
+	b.cleanup(nil, false)
+	assert.Equal(t, []string{"status:failing " + id}, registry.Calls())
+	assert.Len(t, b.services[container.ID], 1)
+
+	// removed while registrator wasn't watching
+	b.docker.(*fakeDocker).containers = map[string]*dockerapi.Container{}
+	b.cleanup(nil, false)
+	assert.Equal(t, []string{"status:failing " + id, "deregister " + id}, registry.Calls())
+	assert.NotContains(t, b.services, container.ID)
+
+	// removed with a destroy event
+	container = testContainer([]string{"SERVICE_DEREGISTER=failure=fail,any=deregister"}, "80/tcp")
+	container.State.ExitCode = 3
+	b, registry = registeredBridge(t, container)
+	b.RemoveOnExit(container.ID)
+	b.handle(actionDestroy, container.ID)
+	assert.Equal(t, []string{"status:failing " + id, "deregister " + id}, registry.Calls())
+	assert.NotContains(t, b.services, container.ID)
+}
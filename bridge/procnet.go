@@ -0,0 +1,204 @@
+package bridge
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// Socket states in /proc/<pid>/net/{tcp,udp}, see include/net/tcp_states.h
+const (
+	tcpListen = "0A"
+	udpClosed = "07"
+)
+
+// Default ephemeral port range of Linux, for a /proc without
+// sys/net/ipv4/ip_local_port_range.
+const (
+	ephemeralLow  = 32768
+	ephemeralHigh = 60999
+)
+
+// listeningPorts returns the ports with a listening socket held by the
+// process pid or one of its descendants, read from procPath (usually /proc).
+// The socket tables list every socket of the network namespace, which is the
+// host's for a host network container, so only sockets whose inode is open in
+// the process tree count. Sockets bound to a loopback address are left out, as
+// are unconnected UDP sockets on an ephemeral port, which clients use.
+func listeningPorts(procPath string, pid int) ([]dockerapi.Port, error) {
+	inodes, err := socketInodes(procPath, pid)
+	if err != nil {
+		return nil, err
+	}
+	low, high := ephemeralPorts(procPath)
+
+	seen := make(map[dockerapi.Port]bool)
+	found := false
+	for _, table := range []struct {
+		file, proto, state string
+	}{
+		{"tcp", "tcp", tcpListen},
+		{"tcp6", "tcp", tcpListen},
+		{"udp", "udp", udpClosed},
+		{"udp6", "udp", udpClosed},
+	} {
+		f, err := os.Open(filepath.Join(procPath, strconv.Itoa(pid), "net", table.file))
+		if os.IsNotExist(err) {
+			// e.g. IPv6 disabled
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		found = true
+		ports, err := parseProcNet(f, table.state, inodes)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, port := range ports {
+			if table.proto == "udp" && port >= low && port <= high {
+				continue
+			}
+			seen[dockerapi.Port(strconv.Itoa(port)+"/"+table.proto)] = true
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("no socket tables for pid %d in %s", pid, procPath)
+	}
+
+	ports := make([]dockerapi.Port, 0, len(seen))
+	for port := range seen {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports, nil
+}
+
+// parseProcNet returns the local ports of the sockets in state from a
+// /proc/net/{tcp,tcp6,udp,udp6} table whose inode is in inodes. For UDP, only
+// sockets without a remote address count as listening.
+func parseProcNet(r io.Reader, state string, inodes map[string]bool) ([]int, error) {
+	var ports []int
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx:rx tr:when retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != state || !inodes[fields[9]] {
+			continue
+		}
+		local := strings.SplitN(fields[1], ":", 2)
+		remote := strings.SplitN(fields[2], ":", 2)
+		if len(local) != 2 || len(remote) != 2 || isLoopbackHex(local[0]) {
+			continue
+		}
+		if state == udpClosed && strings.Trim(remote[1], "0") != "" {
+			continue
+		}
+		port, err := strconv.ParseUint(local[1], 16, 16)
+		if err != nil || port == 0 {
+			continue
+		}
+		ports = append(ports, int(port))
+	}
+	return ports, scanner.Err()
+}
+
+// isLoopbackHex reports whether a hex encoded address from /proc/net is
+// 127.0.0.0/8 or ::1. Addresses are stored as native endian 32 bit words,
+// which this assumes to be little endian.
+func isLoopbackHex(addr string) bool {
+	switch len(addr) {
+	case 8:
+		return strings.HasSuffix(addr, "7F")
+	case 32:
+		return addr == "00000000000000000000000001000000" ||
+			// IPv4-mapped ::ffff:127.x.x.x
+			strings.HasPrefix(addr, "0000000000000000FFFF0000") && strings.HasSuffix(addr, "7F")
+	}
+	return false
+}
+
+// socketInodes returns the inodes of the sockets open in the process pid and
+// its descendants.
+func socketInodes(procPath string, pid int) (map[string]bool, error) {
+	inodes := make(map[string]bool)
+	for i, p := range processTree(procPath, pid) {
+		fdPath := filepath.Join(procPath, strconv.Itoa(p), "fd")
+		fds, err := ioutil.ReadDir(fdPath)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			// exited meanwhile
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdPath, fd.Name()))
+			if err == nil && strings.HasPrefix(link, "socket:[") && strings.HasSuffix(link, "]") {
+				inodes[link[len("socket:["):len(link)-1]] = true
+			}
+		}
+	}
+	return inodes, nil
+}
+
+// processTree returns pid followed by its descendants, found through the
+// parent pids in /proc/<pid>/stat.
+func processTree(procPath string, pid int) []int {
+	children := make(map[int][]int)
+	dirs, _ := ioutil.ReadDir(procPath)
+	for _, dir := range dirs {
+		child, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile(filepath.Join(procPath, dir.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid ..., where comm may contain spaces and parens
+		s := string(stat)
+		fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+		if len(fields) < 2 {
+			continue
+		}
+		if parent, err := strconv.Atoi(fields[1]); err == nil && child != pid {
+			children[parent] = append(children[parent], child)
+		}
+	}
+
+	tree := []int{pid}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+	return tree
+}
+
+// ephemeralPorts returns the range of local ports the kernel binds clients
+// to, from procPath/sys/net/ipv4/ip_local_port_range.
+func ephemeralPorts(procPath string) (int, int) {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, "sys", "net", "ipv4", "ip_local_port_range"))
+	if err != nil {
+		return ephemeralLow, ephemeralHigh
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return ephemeralLow, ephemeralHigh
+	}
+	low, err1 := strconv.Atoi(fields[0])
+	high, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || low > high {
+		return ephemeralLow, ephemeralHigh
+	}
+	return low, high
+}
@@ -0,0 +1,92 @@
+package bridge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0CEA 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2 1 0000000000000000 100 0 0 10 0
+   2: 0200000A:1F90 0300000A:D431 01 00000000:00000000 00:00000000 00000000     0        0 3 1 0000000000000000 20 4 30 10 -1
+   3: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 99 1 0000000000000000 100 0 0 10 0
+`
+
+const procNetTCP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:2382 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 4 1 0000000000000000 100 0 0 10 0
+   1: 00000000000000000000000001000000:1770 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 5 1 0000000000000000 100 0 0 10 0
+`
+
+const procNetUDP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  10: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 6 2 0000000000000000 0
+  11: 0200000A:9C40 08080808:0035 01 00000000:00000000 00:00000000 00000000     0        0 7 2 0000000000000000 0
+  12: 00000000:C350 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 8 2 0000000000000000 0
+`
+
+func TestParseProcNet(t *testing.T) {
+	inodes := map[string]bool{"1": true, "2": true, "3": true, "4": true, "5": true, "6": true, "7": true}
+	ports, err := parseProcNet(strings.NewReader(procNetTCP), tcpListen, inodes)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{8080}, ports)
+
+	ports, err = parseProcNet(strings.NewReader(procNetTCP6), tcpListen, inodes)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{9090}, ports)
+
+	ports, err = parseProcNet(strings.NewReader(procNetUDP), udpClosed, inodes)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{53}, ports)
+
+	// sockets of other processes in the namespace
+	ports, err = parseProcNet(strings.NewReader(procNetTCP), tcpListen, map[string]bool{"2": true})
+	assert.NoError(t, err)
+	assert.Empty(t, ports)
+}
+
+func TestListeningPorts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	net := filepath.Join(dir, "42", "net")
+	assert.NoError(t, os.MkdirAll(net, 0755))
+	for file, content := range map[string]string{
+		"tcp":  procNetTCP,
+		"tcp6": procNetTCP6,
+		"udp":  procNetUDP,
+	} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(net, file), []byte(content), 0644))
+	}
+	// 42 holds the TCP and UDP sockets, its child 44 the TCP6 one, and the
+	// sshd socket with inode 99 belongs to the host
+	withSockets(t, dir, 42, 1, "1", "3", "6", "8")
+	withSockets(t, dir, 44, 42, "4")
+	withSockets(t, dir, 45, 1, "99")
+
+	ports, err := listeningPorts(dir, 42)
+	assert.NoError(t, err)
+	assert.Equal(t, []dockerapi.Port{"53/udp", "8080/tcp", "9090/tcp"}, ports)
+
+	_, err = listeningPorts(dir, 43)
+	assert.Error(t, err)
+}
+
+// withSockets adds a process with a parent and open sockets to a fake /proc.
+func withSockets(t *testing.T, proc string, pid, ppid int, inodes ...string) {
+	dir := filepath.Join(proc, strconv.Itoa(pid))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "fd"), 0755))
+	stat := fmt.Sprintf("%d (my (app)) S %d 1 1 0 -1", pid, ppid)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644))
+	for i, inode := range inodes {
+		fd := filepath.Join(dir, "fd", strconv.Itoa(i+3))
+		assert.NoError(t, os.Symlink("socket:["+inode+"]", fd))
+	}
+}
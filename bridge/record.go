@@ -0,0 +1,105 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// RecordFormat is how a key-value backend stores a service, as set with its
+// "?format=" option.
+type RecordFormat string
+
+const (
+	// RecordPlain stores the address of a service, the default.
+	RecordPlain RecordFormat = "plain"
+	// RecordJSON stores a Record, which backends can list on resync.
+	RecordJSON RecordFormat = "json"
+)
+
+// ParseRecordFormat returns the format given by a "?format=" option.
+func ParseRecordFormat(format string) (RecordFormat, error) {
+	switch RecordFormat(format) {
+	case "", RecordPlain:
+		return RecordPlain, nil
+	case RecordJSON:
+		return RecordJSON, nil
+	}
+	return "", fmt.Errorf("format must be \"plain\" or \"json\": %s", format)
+}
+
+// Encode returns the value stored for a service.
+func (f RecordFormat) Encode(service *Service) ([]byte, error) {
+	if f == RecordJSON {
+		return json.Marshal(NewRecord(service))
+	}
+	return []byte(net.JoinHostPort(service.IP, strconv.Itoa(service.Port))), nil
+}
+
+// Hides reports whether a service is left out of the backend while it is
+// unavailable. Plain entries can't carry the status, so unavailable services
+// are removed until they are available again.
+func (f RecordFormat) Hides(service *Service) bool {
+	return f != RecordJSON && service.Status() != ""
+}
+
+// DecodeRecords returns the services of the stored values that are JSON
+// records, skipping those not written by registrator.
+func DecodeRecords(values [][]byte) []*Service {
+	out := make([]*Service, 0, len(values))
+	for _, value := range values {
+		var record Record
+		if err := json.Unmarshal(value, &record); err != nil || record.ID == "" {
+			continue
+		}
+		out = append(out, record.Service())
+	}
+	return out
+}
+
+// Record is the JSON document key-value backends store for a service when
+// they are configured to store more than its address.
+type Record struct {
+	ID    string               `json:"id"`
+	Name  string               `json:"name"`
+	IP    string               `json:"ip"`
+	Port  int                  `json:"port"`
+	Tags  []string             `json:"tags,omitempty"`
+	Attrs map[string]string    `json:"attrs,omitempty"`
+	Ports map[string]NamedPort `json:"ports,omitempty"`
+	Owner *Owner               `json:"owner,omitempty"`
+	// Status is the Service.Status of an unavailable service, e.g.
+	// "unhealthy" or "draining"
+	Status string `json:"status,omitempty"`
+}
+
+func NewRecord(service *Service) *Record {
+	return &Record{
+		ID:    service.ID,
+		Name:  service.Name,
+		IP:    service.IP,
+		Port:  service.Port,
+		Tags:  service.Tags,
+		Attrs: service.Attrs,
+		Ports: service.Ports,
+		Owner: service.Owner,
+
+		Status: service.Status(),
+	}
+}
+
+// Service returns the registered service a record describes, for the
+// Services of key-value backends.
+func (r *Record) Service() *Service {
+	return &Service{
+		ID:    r.ID,
+		Name:  r.Name,
+		IP:    r.IP,
+		Port:  r.Port,
+		Tags:  r.Tags,
+		Attrs: r.Attrs,
+		Ports: r.Ports,
+		Owner: r.Owner,
+	}
+}
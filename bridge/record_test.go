@@ -0,0 +1,41 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRecordFormat(t *testing.T) {
+	for text, expected := range map[string]RecordFormat{
+		"":      RecordPlain,
+		"plain": RecordPlain,
+		"json":  RecordJSON,
+	} {
+		format, err := ParseRecordFormat(text)
+		assert.NoError(t, err, text)
+		assert.Equal(t, expected, format, text)
+	}
+	_, err := ParseRecordFormat("yaml")
+	assert.Error(t, err)
+}
+
+func TestRecordFormat(t *testing.T) {
+	service := &Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 80,
+		Attrs: map[string]string{"draining": "true"}}
+
+	value, err := RecordPlain.Encode(service)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:80", string(value))
+	assert.True(t, RecordPlain.Hides(service))
+	assert.False(t, RecordJSON.Hides(service))
+
+	value, err = RecordJSON.Encode(service)
+	assert.NoError(t, err)
+	assert.Contains(t, string(value), `"status":"draining"`)
+	services := DecodeRecords([][]byte{value, []byte("10.0.0.1:80"), []byte(`{"name":"other"}`)})
+	if assert.Len(t, services, 1) {
+		assert.Equal(t, "host:web:80", services[0].ID)
+		assert.Equal(t, service.Attrs, services[0].Attrs)
+	}
+}
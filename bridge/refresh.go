@@ -0,0 +1,205 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// refreshTick is how often the refresh scheduler looks for services due.
+var refreshTick = time.Second
+
+// RefreshLoop refreshes the TTL of each service on its own schedule until
+// quit is closed. Services are refreshed every -ttl-refresh seconds, or half
+// their TTL without it, less some jitter so that services registered together
+// don't refresh in bursts. A failed refresh is retried sooner. Only the
+// containers with a service due are visited, so the loop idles when no
+// service has a TTL.
+func (b *Bridge) RefreshLoop(quit <-chan struct{}) {
+	ticker := time.NewTicker(refreshTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.refreshAll(false)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Refresh refreshes the TTL of all registered and draining services right
+// away. Dead and failed services aren't refreshed, and are forgotten once
+// their TTL expired. Containers busy with another operation are left for the
+// next refresh.
+func (b *Bridge) Refresh() {
+	b.refreshAll(true)
+}
+
+// refreshAll refreshes the services of all containers when forced, and
+// otherwise the ones of containers with a service due.
+func (b *Bridge) refreshAll(force bool) {
+	containerIds := b.containerIds()
+	if !force {
+		containerIds = b.dueContainers(time.Now())
+	}
+	parallel(containerIds, registryConcurrency, func(containerId string) {
+		b.refresh(containerId, force)
+	})
+}
+
+// dueContainers returns the containers with a service due for a refresh, or
+// whose TTL expired.
+func (b *Bridge) dueContainers(now time.Time) []string {
+	b.Lock()
+	defer b.Unlock()
+	var ids []string
+	for containerId, services := range b.services {
+		for _, service := range services {
+			if b.due(service, now) {
+				ids = append(ids, containerId)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// due reports whether a service is due for a refresh, or expired. It is
+// called with the bridge lock held.
+func (b *Bridge) due(service *Service, now time.Time) bool {
+	if b.expired(service, now) {
+		return true
+	}
+	if state := service.State(); state != StateRegistered && state != StateDraining {
+		return false
+	}
+	return b.refreshInterval(service) > 0 && !now.Before(service.nextRefresh)
+}
+
+// refresh refreshes the services of a container that are due, or all of them
+// when forced.
+func (b *Bridge) refresh(containerId string, force bool) {
+	unlock, ok := b.containers.tryLock(containerId)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	now := time.Now()
+	var refresh []*Service
+	b.Lock()
+	var kept []*Service
+	for _, service := range b.services[containerId] {
+		if b.expired(service, now) {
+			service.transition(StateDeregistered, "ttl expired")
+			log.Println("expired:", containerId[:12], service.ID)
+			continue
+		}
+		kept = append(kept, service)
+		if state := service.State(); state != StateRegistered && state != StateDraining {
+			continue
+		}
+		interval := b.refreshInterval(service)
+		switch {
+		case force:
+		case interval <= 0:
+			continue
+		case service.nextRefresh.IsZero():
+			// just registered, spread the first refresh over the interval
+			service.nextRefresh = now.Add(interval/2 + randDuration(interval/2))
+			continue
+		case now.Before(service.nextRefresh):
+			continue
+		}
+		refresh = append(refresh, service)
+	}
+	if kept == nil {
+		delete(b.services, containerId)
+		delete(b.health, containerId)
+	} else {
+		b.services[containerId] = kept
+	}
+	b.Unlock()
+
+	for _, service := range refresh {
+		err := b.registry.Refresh(service)
+
+		b.Lock()
+		interval := b.refreshInterval(service)
+		if err != nil {
+			service.refreshFailures++
+			service.nextRefresh = time.Now().Add(retryDelay(interval, service.refreshFailures))
+		} else {
+			service.refreshFailures = 0
+			service.nextRefresh = time.Now().Add(interval - randDuration(interval/5))
+		}
+		b.Unlock()
+
+		if err != nil {
+			log.Println("refresh failed:", service.ID, err)
+			continue
+		}
+		log.Println("refreshed:", containerId[:12], service.ID)
+	}
+}
+
+// refreshInterval returns how often a service is refreshed: -ttl-refresh, or
+// half its TTL for a service with SERVICE_TTL while -ttl-refresh is unset.
+// Services of containers with a Docker health check are refreshed every half
+// SERVICE_CHECK_TTL without a TTL, for backends to pass the check with their
+// health. Other services without a TTL aren't refreshed.
+func (b *Bridge) refreshInterval(service *Service) time.Duration {
+	if b.config.RefreshInterval > 0 {
+		return time.Duration(b.config.RefreshInterval) * time.Second
+	}
+	if service.TTL == 0 && service.Attrs[HealthAttr] != "" {
+		if ttl, err := parseDuration(service.Attrs["check_ttl"]); err == nil && ttl > 0 {
+			return ttl / 2
+		}
+	}
+	return time.Duration(service.TTL) * time.Second / 2
+}
+
+// retryDelay returns when a failed refresh is retried: an eighth of the
+// interval, doubling with each consecutive failure up to half the interval.
+func retryDelay(interval time.Duration, failures int) time.Duration {
+	delay := interval / 8
+	for i := 1; i < failures && delay < interval/2; i++ {
+		delay *= 2
+	}
+	if delay > interval/2 {
+		delay = interval / 2
+	}
+	if delay < refreshTick {
+		delay = refreshTick
+	}
+	return delay
+}
+
+func randDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// serviceTTL parses SERVICE_TTL, a number of seconds or a Go duration. Like
+// -ttl, it must be greater than -ttl-refresh.
+func (b *Bridge) serviceTTL(text string) (int, error) {
+	d, err := parseDuration(text)
+	if err != nil {
+		return 0, err
+	}
+	ttl := int(d / time.Second)
+	if ttl < 1 {
+		return 0, errors.New("ttl " + strconv.Quote(text) + " is shorter than a second")
+	}
+	if b.config.RefreshInterval > 0 && ttl <= b.config.RefreshInterval {
+		return 0, fmt.Errorf("ttl %ds must be greater than -ttl-refresh %ds", ttl, b.config.RefreshInterval)
+	}
+	return ttl, nil
+}
@@ -0,0 +1,107 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceTTL(t *testing.T) {
+	b := testBridge(t, Config{RefreshTtl: 60, RefreshInterval: 10})
+	for text, ttl := range map[string]int{
+		"":    60,
+		"30":  30,
+		"2m":  120,
+		"10":  60,
+		"5s":  60,
+		"0":   60,
+		"abc": 60,
+	} {
+		var env []string
+		if text != "" {
+			env = []string{"SERVICE_TTL=" + text}
+		}
+		container := testContainer(env, "80/tcp")
+		port := servicePort(container, "80/tcp", container.NetworkSettings.Ports["80/tcp"])
+		service := b.newService(port, false, nil)[0]
+		assert.Equal(t, ttl, service.TTL, text)
+		assert.NotContains(t, service.Attrs, "ttl")
+	}
+
+	container := testContainer([]string{"SERVICE_443_TTL=20"}, "80/tcp", "443/tcp")
+	port := servicePort(container, "443/tcp", container.NetworkSettings.Ports["443/tcp"])
+	assert.Equal(t, 20, b.newService(port, false, nil)[0].TTL)
+	port = servicePort(container, "80/tcp", container.NetworkSettings.Ports["80/tcp"])
+	assert.Equal(t, 60, b.newService(port, false, nil)[0].TTL)
+}
+
+func TestRefreshSchedule(t *testing.T) {
+	container := testContainer([]string{"SERVICE_TTL=40"}, "80/tcp")
+	b, registry := registeredBridge(t, container)
+	service := b.services[container.ID][0]
+	assert.Equal(t, 40, service.TTL)
+
+	// the first refresh is spread over the interval of half the TTL
+	b.refreshAll(false)
+	assert.Empty(t, registry.Calls())
+	assert.WithinDuration(t, time.Now().Add(15*time.Second), service.nextRefresh, 5*time.Second)
+
+	b.refreshAll(false)
+	assert.Empty(t, registry.Calls())
+
+	service.nextRefresh = time.Now()
+	b.refreshAll(false)
+	assert.Equal(t, []string{"refresh " + service.ID}, registry.Calls())
+	assert.WithinDuration(t, time.Now().Add(18*time.Second), service.nextRefresh, 2*time.Second)
+
+	b.Refresh()
+	assert.Len(t, registry.Calls(), 2)
+}
+
+func TestRefreshOnlyDue(t *testing.T) {
+	container := testContainer(nil, "80/tcp")
+	b, _ := registeredBridge(t, container)
+	assert.Empty(t, b.dueContainers(time.Now()))
+
+	service := b.services[container.ID][0]
+	service.TTL = 40
+	assert.Equal(t, []string{container.ID}, b.dueContainers(time.Now()))
+	service.nextRefresh = time.Now().Add(time.Minute)
+	assert.Empty(t, b.dueContainers(time.Now()))
+}
+
+func TestRefreshRetry(t *testing.T) {
+	container := testContainer(nil, "80/tcp")
+	b, registry := registeredBridge(t, container)
+	b.config.RefreshTtl, b.config.RefreshInterval = 80, 64
+	service := b.services[container.ID][0]
+	registry.refreshErr = errors.New("unavailable")
+
+	service.nextRefresh = time.Now()
+	b.refreshAll(false)
+	assert.Equal(t, 1, service.refreshFailures)
+	assert.WithinDuration(t, time.Now().Add(8*time.Second), service.nextRefresh, time.Second)
+
+	service.nextRefresh = time.Now()
+	b.refreshAll(false)
+	assert.WithinDuration(t, time.Now().Add(16*time.Second), service.nextRefresh, time.Second)
+
+	registry.mu.Lock()
+	registry.refreshErr = nil
+	registry.mu.Unlock()
+	service.nextRefresh = time.Now()
+	b.refreshAll(false)
+	assert.Equal(t, 0, service.refreshFailures)
+	assert.True(t, service.nextRefresh.After(time.Now().Add(50*time.Second)))
+}
+
+func TestRetryDelay(t *testing.T) {
+	interval := 80 * time.Second
+	assert.Equal(t, 10*time.Second, retryDelay(interval, 1))
+	assert.Equal(t, 20*time.Second, retryDelay(interval, 2))
+	assert.Equal(t, 40*time.Second, retryDelay(interval, 3))
+	assert.Equal(t, 40*time.Second, retryDelay(interval, 10))
+	assert.Equal(t, refreshTick, retryDelay(4*time.Second, 1))
+}
@@ -0,0 +1,352 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ServicesLabel holds a JSON or YAML list of service definitions, an
+// alternative to SERVICE_<port>_<key> metadata for complex services.
+const ServicesLabel = "registrator.services"
+
+type serviceSpec struct {
+	// Port is the exposed port the entry applies to, e.g. 8080 or "53/udp".
+	// Entries without a port apply to every service of the container.
+	Port   interface{}            `json:"port" yaml:"port"`
+	Name   string                 `json:"name" yaml:"name"`
+	ID     string                 `json:"id" yaml:"id"`
+	Tags   []string               `json:"tags" yaml:"tags"`
+	Ignore bool                   `json:"ignore" yaml:"ignore"`
+	Check  *checkSpec             `json:"check" yaml:"check"`
+	Attrs  map[string]interface{} `json:"attrs" yaml:"attrs"`
+
+	Aliases []aliasSpec `json:"aliases" yaml:"aliases"`
+
+	port     string
+	portType string
+}
+
+type aliasSpec struct {
+	Name string   `json:"name" yaml:"name"`
+	Tags []string `json:"tags" yaml:"tags"`
+}
+
+type checkSpec struct {
+	HTTP            string `json:"http" yaml:"http"`
+	HTTPS           string `json:"https" yaml:"https"`
+	Method          string `json:"method" yaml:"method"`
+	TCP             bool   `json:"tcp" yaml:"tcp"`
+	GRPC            bool   `json:"grpc" yaml:"grpc"`
+	GRPCUseTLS      bool   `json:"grpc_use_tls" yaml:"grpc_use_tls"`
+	TLSSkipVerify   bool   `json:"tls_skip_verify" yaml:"tls_skip_verify"`
+	Script          string `json:"script" yaml:"script"`
+	Cmd             string `json:"cmd" yaml:"cmd"`
+	TTL             string `json:"ttl" yaml:"ttl"`
+	Interval        string `json:"interval" yaml:"interval"`
+	Timeout         string `json:"timeout" yaml:"timeout"`
+	InitialStatus   string `json:"initial_status" yaml:"initial_status"`
+	DeregisterAfter string `json:"deregister_after" yaml:"deregister_after"`
+}
+
+// parseServiceSpecs decodes and validates the ServicesLabel document.
+func parseServiceSpecs(doc string) ([]serviceSpec, error) {
+	var specs []serviceSpec
+	trimmed := strings.TrimSpace(doc)
+	if trimmed == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(trimmed, "{") {
+		return nil, fmt.Errorf("%s: expected a list of services, got an object; wrap it in [...]", ServicesLabel)
+	}
+	if strings.HasPrefix(trimmed, "[") {
+		dec := json.NewDecoder(strings.NewReader(trimmed))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&specs); err != nil {
+			return nil, fmt.Errorf("%s: invalid JSON: %v", ServicesLabel, err)
+		}
+	} else if err := yaml.UnmarshalStrict([]byte(trimmed), &specs); err != nil {
+		return nil, fmt.Errorf("%s: invalid YAML: %v", ServicesLabel, err)
+	}
+
+	var errs []string
+	seen := make(map[string]int)
+	for i := range specs {
+		spec := &specs[i]
+		for _, err := range spec.validate() {
+			errs = append(errs, fmt.Sprintf("services[%d].%s", i, err))
+		}
+		key := spec.port + "/" + spec.portType
+		if j, ok := seen[key]; ok {
+			errs = append(errs, fmt.Sprintf("services[%d].port: duplicates services[%d]", i, j))
+		}
+		seen[key] = i
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s: %s", ServicesLabel, strings.Join(errs, "; "))
+	}
+	return specs, nil
+}
+
+func (s *serviceSpec) validate() []string {
+	var errs []string
+
+	switch p := s.Port.(type) {
+	case nil:
+	case string:
+		s.port = p
+	case int:
+		s.port = strconv.Itoa(p)
+	case float64:
+		s.port = strconv.FormatFloat(p, 'f', -1, 64)
+	default:
+		errs = append(errs, fmt.Sprintf("port: expected number or string, got %v", p))
+	}
+	if s.port != "" {
+		parts := strings.SplitN(s.port, "/", 2)
+		s.port = parts[0]
+		if n, err := strconv.Atoi(s.port); err != nil || n < 1 || n > 65535 {
+			errs = append(errs, fmt.Sprintf("port: %q is not a valid port number", s.port))
+		}
+		if len(parts) == 2 {
+			s.portType = strings.ToLower(parts[1])
+			if !knownPortTypes[s.portType] {
+				errs = append(errs, fmt.Sprintf("port: unsupported protocol %q", parts[1]))
+			}
+		}
+	}
+
+	if s.Name != "" && strings.TrimSpace(s.Name) != s.Name {
+		errs = append(errs, fmt.Sprintf("name: %q has surrounding whitespace", s.Name))
+	}
+	for i, tag := range s.Tags {
+		if tag == "" {
+			errs = append(errs, fmt.Sprintf("tags[%d]: must not be empty", i))
+		}
+	}
+	for k := range s.Attrs {
+		if k == "" {
+			errs = append(errs, "attrs: keys must not be empty")
+		}
+	}
+	if s.Check != nil {
+		errs = append(errs, s.Check.validate()...)
+	}
+	for i, alias := range s.Aliases {
+		if !aliasPattern.MatchString(alias.Name) {
+			errs = append(errs, fmt.Sprintf("aliases[%d].name: %q may only contain letters, digits, '_', '.' and '-'", i, alias.Name))
+		} else if knownPortTypes[strings.ToLower(alias.Name)] {
+			errs = append(errs, fmt.Sprintf("aliases[%d].name: %q is a protocol name", i, alias.Name))
+		}
+	}
+	return errs
+}
+
+func (c *checkSpec) validate() []string {
+	var errs []string
+
+	kinds := 0
+	for _, set := range []bool{c.HTTP != "", c.HTTPS != "", c.TCP, c.GRPC, c.Script != "", c.Cmd != "", c.TTL != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds == 0 {
+		errs = append(errs, "check: one of http, https, tcp, grpc, script, cmd or ttl is required")
+	} else if kinds > 1 {
+		errs = append(errs, "check: only one of http, https, tcp, grpc, script, cmd or ttl may be set")
+	}
+	if c.Method != "" && c.HTTP == "" && c.HTTPS == "" {
+		errs = append(errs, "check.method: only valid for http and https checks")
+	}
+	if (c.GRPCUseTLS || c.TLSSkipVerify) && !c.GRPC {
+		errs = append(errs, "check.grpc_use_tls: only valid for grpc checks")
+	}
+	for field, value := range map[string]string{
+		"ttl":              c.TTL,
+		"interval":         c.Interval,
+		"timeout":          c.Timeout,
+		"deregister_after": c.DeregisterAfter,
+	} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(value); err != nil {
+			errs = append(errs, fmt.Sprintf("check.%s: %q is not a valid duration", field, value))
+		}
+	}
+	switch c.InitialStatus {
+	case "", "passing", "warning", "critical":
+	default:
+		errs = append(errs, fmt.Sprintf("check.initial_status: %q must be passing, warning or critical", c.InitialStatus))
+	}
+	return errs
+}
+
+// matches reports whether the entry applies to port specifically.
+func (s *serviceSpec) matches(port ServicePort) bool {
+	return s.port == port.ExposedPort && (s.portType == "" || s.portType == port.PortType)
+}
+
+// metadata flattens the entry into SERVICE_<key> style metadata.
+func (s *serviceSpec) metadata() map[string]string {
+	m := make(map[string]string)
+	for k, v := range s.Attrs {
+		m[k] = attrString(v)
+	}
+	if s.Check != nil {
+		for k, v := range s.Check.metadata() {
+			m[k] = v
+		}
+	}
+	if s.Name != "" {
+		m["name"] = s.Name
+	}
+	if s.ID != "" {
+		m["id"] = s.ID
+	}
+	if s.Ignore {
+		m["ignore"] = "true"
+	}
+	if len(s.Aliases) > 0 {
+		names := make([]string, len(s.Aliases))
+		for i, alias := range s.Aliases {
+			names[i] = alias.Name
+			if len(alias.Tags) > 0 {
+				tags := make([]string, len(alias.Tags))
+				for j, tag := range alias.Tags {
+					tags[j] = strings.Replace(tag, ",", "\\,", -1)
+				}
+				m["alias_"+strings.ToLower(alias.Name)+"_tags"] = strings.Join(tags, ",")
+			}
+		}
+		m["aliases"] = strings.Join(names, ",")
+	}
+	return m
+}
+
+func (c *checkSpec) metadata() map[string]string {
+	m := make(map[string]string)
+	set := func(key, value string) {
+		if value != "" {
+			m[key] = value
+		}
+	}
+	set("check_http", c.HTTP)
+	set("check_https", c.HTTPS)
+	if c.HTTP != "" {
+		set("check_http_method", c.Method)
+	} else {
+		set("check_https_method", c.Method)
+	}
+	if c.TCP {
+		m["check_tcp"] = "true"
+	}
+	if c.GRPC {
+		m["check_grpc"] = "true"
+	}
+	if c.GRPCUseTLS {
+		m["check_grpc_use_tls"] = "true"
+	}
+	if c.TLSSkipVerify {
+		m["check_tls_skip_verify"] = "true"
+	}
+	set("check_script", c.Script)
+	set("check_cmd", c.Cmd)
+	set("check_ttl", c.TTL)
+	set("check_interval", c.Interval)
+	set("check_timeout", c.Timeout)
+	set("check_initial_status", c.InitialStatus)
+	set("check_deregister_after", c.DeregisterAfter)
+	return m
+}
+
+// attrString renders a typed attribute value as a string. Lists and objects
+// are encoded as JSON.
+func attrString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int, int64, bool:
+		return fmt.Sprint(v)
+	}
+	js, err := json.Marshal(jsonValue(v))
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(js)
+}
+
+// jsonValue converts the map[interface{}]interface{} values produced by the
+// YAML decoder into something encoding/json accepts.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = jsonValue(e)
+		}
+		return l
+	}
+	return v
+}
+
+// mergeServiceSpecs folds the entries of specs into the metadata collected
+// from SERVICE_* variables. From most to least specific: SERVICE_<port>_<key>,
+// the entry for the port, SERVICE_<key>, the entry without a port. Tags of the
+// winning entry are returned as is, without comma splitting, and nil is
+// returned when SERVICE_*TAGS applies.
+func mergeServiceSpecs(specs []serviceSpec, port ServicePort, metadata map[string]string, metadataFromPort map[string]bool) []string {
+	var tags []string
+	tagsFromPort := metadataFromPort["tags"]
+	for _, spec := range specs {
+		if spec.port == "" || !spec.matches(port) {
+			continue
+		}
+		for k, v := range spec.metadata() {
+			if !metadataFromPort[k] {
+				metadata[k] = v
+				metadataFromPort[k] = true
+			}
+		}
+		if spec.Tags != nil && !tagsFromPort {
+			tags = spec.Tags
+			delete(metadata, "tags")
+			metadataFromPort["tags"] = true
+		}
+	}
+	for _, spec := range specs {
+		if spec.port != "" {
+			continue
+		}
+		for k, v := range spec.metadata() {
+			if _, ok := metadata[k]; !ok && !metadataFromPort[k] {
+				metadata[k] = v
+			}
+		}
+		if spec.Tags != nil && tags == nil && mapDefault(metadata, "tags", "") == "" && !metadataFromPort["tags"] {
+			tags = spec.Tags
+		}
+	}
+	return tags
+}
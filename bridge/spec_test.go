@@ -0,0 +1,114 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseServiceSpecsJSON(t *testing.T) {
+	specs, err := parseServiceSpecs(`[
+		{"port": 8080, "name": "api", "tags": ["a,b", "v1"],
+		 "check": {"http": "/health", "interval": "5s"},
+		 "attrs": {"weight": 10, "canary": true, "limits": {"rps": 100}}},
+		{"port": "53/udp", "name": "dns"},
+		{"tags": ["default"]}
+	]`)
+	assert.NoError(t, err)
+	assert.Len(t, specs, 3)
+
+	assert.Equal(t, "8080", specs[0].port)
+	assert.Equal(t, map[string]string{
+		"name":           "api",
+		"check_http":     "/health",
+		"check_interval": "5s",
+		"weight":         "10",
+		"canary":         "true",
+		"limits":         `{"rps":100}`,
+	}, specs[0].metadata())
+	assert.Equal(t, "53", specs[1].port)
+	assert.Equal(t, "udp", specs[1].portType)
+	assert.Equal(t, "", specs[2].port)
+}
+
+func TestParseServiceSpecsYAML(t *testing.T) {
+	specs, err := parseServiceSpecs(`
+- port: 8080
+  name: api
+  tags: [v1]
+  attrs:
+    zone: {name: a}
+`)
+	assert.NoError(t, err)
+	assert.Len(t, specs, 1)
+	assert.Equal(t, "8080", specs[0].port)
+	assert.Equal(t, `{"name":"a"}`, specs[0].metadata()["zone"])
+}
+
+func TestParseServiceSpecsErrors(t *testing.T) {
+	cases := []struct {
+		Doc   string
+		Error string
+	}{
+		{`[{"port": "http"}]`, `services[0].port: "http" is not a valid port number`},
+		{`[{"port": "53/icmp"}]`, `services[0].port: unsupported protocol "icmp"`},
+		{`[{"port": 80}, {"port": "80"}]`, `services[1].port: duplicates services[0]`},
+		{`[{"port": 80, "check": {"http": "/", "tcp": true}}]`, `services[0].check: only one of`},
+		{`[{"port": 80, "check": {"ttl": "soon"}}]`, `services[0].check.ttl: "soon" is not a valid duration`},
+		{`[{"prot": 80}]`, `invalid JSON`},
+		{"- prot: 80", `invalid YAML`},
+		{`{"port": 80}`, `expected a list of services`},
+	}
+	for _, c := range cases {
+		_, err := parseServiceSpecs(c.Doc)
+		if assert.Error(t, err, c.Doc) {
+			assert.Contains(t, err.Error(), c.Error)
+		}
+	}
+}
+
+func TestMergeServiceSpecs(t *testing.T) {
+	specs, err := parseServiceSpecs(`[
+		{"port": 80, "name": "web", "id": "web-1", "tags": ["x"]},
+		{"name": "fallback", "attrs": {"region": "eu", "tier": "front"}}
+	]`)
+	assert.NoError(t, err)
+
+	metadata := map[string]string{"id": "from-env", "tier": "back"}
+	fromPort := map[string]bool{"id": true}
+	tags := mergeServiceSpecs(specs, ServicePort{ExposedPort: "80", PortType: "tcp"}, metadata, fromPort)
+
+	assert.Equal(t, []string{"x"}, tags)
+	assert.Equal(t, map[string]string{
+		"id":     "from-env",
+		"name":   "web",
+		"region": "eu",
+		"tier":   "back",
+	}, metadata)
+	assert.True(t, fromPort["name"])
+
+	metadata = map[string]string{"tags": "env"}
+	tags = mergeServiceSpecs(specs, ServicePort{ExposedPort: "443", PortType: "tcp"}, metadata, map[string]bool{})
+	assert.Nil(t, tags)
+	assert.Equal(t, "fallback", metadata["name"])
+	assert.Equal(t, "env", metadata["tags"])
+}
+
+func TestServiceSpecAliases(t *testing.T) {
+	specs, err := parseServiceSpecs(`[{"port": 80, "aliases": [{"name": "Legacy", "tags": ["a,b"]}, {"name": "v2"}]}]`)
+	assert.NoError(t, err)
+
+	metadata := specs[0].metadata()
+	assert.Equal(t, "Legacy,v2", metadata["aliases"])
+	assert.Equal(t, []serviceAlias{
+		{name: "Legacy", tags: `a\,b`},
+		{name: "v2"},
+	}, serviceAliases(metadata))
+
+	_, err = parseServiceSpecs(`[{"port": 80, "aliases": [{"name": "a b"}]}]`)
+	assert.Error(t, err)
+	_, err = parseServiceSpecs(`[{"port": 80, "aliases": [{"name": "v2"}, {"name": "UDP"}]}]`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `aliases[1].name: "UDP" is a protocol name`)
+	}
+}
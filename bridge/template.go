@@ -0,0 +1,357 @@
+package bridge
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"strings"
+	"text/template"
+
+	jsonp "github.com/buger/jsonparser"
+)
+
+// renderTemplate executes text as a Go template against data using the
+// template functions below. Empty text renders to an empty string.
+func (b *Bridge) renderTemplate(name, text string, data interface{}) (string, error) {
+	if len(text) == 0 {
+		return "", nil
+	}
+
+	tmpl, err := template.New(name).Funcs(b.templateFuncs()).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Template functions
+func (b *Bridge) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		// Template function name: strSlice
+		// Description: Slice string from start to end (same as s[start:end] where s represents string).
+		//
+		// Usage: strSlice s start end
+		//
+		// Example: strSlice .ID 0 12
+		// {
+		//     "Id": "e20f9c1a76565d62ae24a3bb877b17b862b6eab94f4e95a0e07ccf25087aaf4f"
+		// }
+		// Output: "e20f9c1a7656"
+		//
+		"strSlice": func(v string, i ...int) string {
+			if len(i) == 1 {
+				if len(v) >= i[0] {
+					return v[i[0]:]
+				}
+			}
+
+			if len(i) == 2 {
+				if len(v) >= i[0] && len(v) >= i[1] {
+					if i[0] == 0 {
+						return v[:i[1]]
+					}
+					if i[1] < i[0] {
+						return v[i[0]:]
+					}
+					return v[i[0]:i[1]]
+				}
+			}
+
+			return v
+		},
+		// Template function name: sIndex
+		// Description: Return element from slice or array s by specifiying index i (same as s[i] where s represents slice or array - index i can also take negative values to extract elements in reverse order).
+		//
+		// Usage: sIndex i s
+		//
+		// Example: sIndex 0 .Config.Env
+		// {
+		//     "Config": {
+		//         "Env": [
+		//             "ENVIRONMENT=test",
+		//             "SERVICE_8105_NAME=foo",
+		//             "HOME=/home/foobar",
+		//             "SERVICE_9404_NAME=bar"
+		//         ]
+		//     }
+		// }
+		// Output: "ENVIRONMENT=test"
+		//
+		"sIndex": func(i int, s []string) string {
+			if i < 0 {
+				i = i * -1
+				if i >= len(s) {
+					return s[0]
+				}
+				return s[len(s)-i]
+			}
+
+			if i >= len(s) {
+				return s[len(s)-1]
+			}
+
+			return s[i]
+		},
+		// Template function name: mIndex
+		// Description: Return value for key k stored in the map m (same as m["k"]).
+		//
+		// Usage: mIndex k m
+		//
+		// Example: mIndex "com.amazonaws.ecs.task-arn" .Config.Labels
+		// {
+		//     "Config": {
+		//         "Labels": {
+		//             "com.amazonaws.ecs.task-arn": "arn:aws:ecs:region:xxxxxxxxxxxx:task/368f4403-0ee4-4f4c-b7a5-be50c57db5cf"
+		//         }
+		//     }
+		// }
+		// Output: "arn:aws:ecs:region:xxxxxxxxxxxx:task/368f4403-0ee4-4f4c-b7a5-be50c57db5cf"
+		//
+		"mIndex": func(k string, m map[string]string) string {
+			return m[k]
+		},
+		// Template function name: toUpper
+		// Description: Return s with all letters mapped to their upper case.
+		//
+		// Usage: toUpper s
+		//
+		// Example: toUpper "foo"
+		// Output: "FOO"
+		//
+		"toUpper": func(v string) string {
+			return strings.ToUpper(v)
+		},
+		// Template function name: toLower
+		// Description: Return s with all letters mapped to their lower case.
+		//
+		// Usage: toLower s
+		//
+		// Example: toLower "FoO"
+		// Output: "foo"
+		//
+		"toLower": func(v string) string {
+			return strings.ToLower(v)
+		},
+		// Template function name: replace
+		// Description: Replace all (-1) or first n occurrences of "old" with "new" found in the designated string s.
+		//
+		// Usage: replace n old new s
+		//
+		// Example: replace -1 "=" "" "=foo="
+		// Output: "foo"
+		//
+		"replace": func(n int, old, new, v string) string {
+			return strings.Replace(v, old, new, n)
+		},
+		// Template function name: join
+		// Description: Create a single string from all the elements found in the slice s where sep will be used as separator.
+		//
+		// Usage: join sep s
+		//
+		// Example: join "," .Config.Env
+		// {
+		//     "Config": {
+		//         "Env": [
+		//             "ENVIRONMENT=test",
+		//             "SERVICE_8105_NAME=foo",
+		//             "HOME=/home/foobar",
+		//             "SERVICE_9404_NAME=bar"
+		//         ]
+		//     }
+		// }
+		// Output: "ENVIRONMENT=test,SERVICE_8105_NAME=foo,HOME=/home/foobar,SERVICE_9404_NAME=bar"
+		//
+		"join": func(sep string, s []string) string {
+			return strings.Join(s, sep)
+		},
+		// Template function name: split
+		// Description: Split string s into all substrings separated by sep and return a slice of the substrings between those separators.
+		//
+		// Usage: split sep s
+		//
+		// Example: split "," "/proc/bus,/proc/fs,/proc/irq"
+		// Output: [/proc/bus /proc/fs /proc/irq]
+		//
+		"split": func(sep, v string) []string {
+			return strings.Split(v, sep)
+		},
+		// Template function name: splitIndex
+		// Description: split and sIndex function combined, index i can also take negative values to extract elements in reverse order.
+		//				Same result can be achieved if using pipeline with both functions: {{ split sep s | sIndex i }}
+		//
+		// Usage: splitIndex i sep s
+		//
+		// Example: splitIndex -1 "/" "arn:aws:ecs:region:xxxxxxxxxxxx:task/368f4403-0ee4-4f4c-b7a5-be50c57db5cf"
+		// Output: "368f4403-0ee4-4f4c-b7a5-be50c57db5cf"
+		//
+		"splitIndex": func(i int, sep, v string) string {
+			l := strings.Split(v, sep)
+
+			if i < 0 {
+				i = i * -1
+				if i >= len(l) {
+					return l[0]
+				}
+				return l[len(l)-i]
+			}
+
+			if i >= len(l) {
+				return l[len(l)-1]
+			}
+
+			return l[i]
+		},
+		// Template function name: matchFirstElement
+		// Description: Iterate through slice s and return first element that match regex expression.
+		//
+		// Usage: matchFirstElement regex s
+		//
+		// Example: matchFirstElement "^SERVICE_" .Config.Env
+		// {
+		//     "Config": {
+		//         "Env": [
+		//             "ENVIRONMENT=test",
+		//             "SERVICE_8105_NAME=foo",
+		//             "HOME=/home/foobar",
+		//             "SERVICE_9404_NAME=bar"
+		//         ]
+		//     }
+		// }
+		// Output: "SERVICE_8105_NAME=foo"
+		//
+		"matchFirstElement": func(r string, s []string) string {
+			var m string
+
+			re := regexp.MustCompile(r)
+			for _, e := range s {
+				if re.MatchString(e) {
+					m = e
+					break
+				}
+			}
+
+			return m
+		},
+		// Template function name: matchAllElements
+		// Description: Iterate through slice s and return slice of all elements that match regex expression.
+		//
+		// Usage: matchAllElements regex s
+		//
+		// Example: matchAllElements "^SERVICE_" .Config.Env
+		// {
+		//     "Config": {
+		//         "Env": [
+		//             "ENVIRONMENT=test",
+		//             "SERVICE_8105_NAME=foo",
+		//             "HOME=/home/foobar",
+		//             "SERVICE_9404_NAME=bar"
+		//         ]
+		//     }
+		// }
+		// Output: [SERVICE_8105_NAME=foo SERVICE_9404_NAME=bar]
+		//
+		"matchAllElements": func(r string, s []string) []string {
+			var m []string
+
+			re := regexp.MustCompile(r)
+			for _, e := range s {
+				if re.MatchString(e) {
+					m = append(m, e)
+				}
+			}
+
+			return m
+		},
+		// Template function name: httpGet
+		// Description: Fetch an object from URL. Responses are cached (see -template-cache-ttl) and a slow or failing URL
+		//				returns the last known body, or an empty one if there is none yet.
+		//
+		// Usage: httpGet url
+		//
+		// Example: httpGet "https://ajpi.me/all"
+		// Output: []byte (e.g. JSON object)
+		//
+		"httpGet": func(url string) []byte {
+			return b.sources["httpGet"].Get(url)
+		},
+		// Template function name: fileRead
+		// Description: Return the contents of the file at path with surrounding whitespace removed. The file has to be
+		//				reachable from inside the registrator container, e.g. through a volume.
+		//
+		// Usage: fileRead path
+		//
+		// Example: fileRead "/etc/host-metadata/rack"
+		// Output: "r12"
+		//
+		"fileRead": func(path string) string {
+			return strings.TrimSpace(string(b.sources["fileRead"].Get(path)))
+		},
+		// Template function name: dnsLookup
+		// Description: Resolve host name and return slice of its addresses.
+		//
+		// Usage: dnsLookup name
+		//
+		// Example: dnsLookup "metadata.internal"
+		// Output: [10.0.0.5 10.0.0.6]
+		//
+		"dnsLookup": func(name string) []string {
+			addrs := string(b.sources["dnsLookup"].Get(name))
+			if addrs == "" {
+				return []string{}
+			}
+			return strings.Split(addrs, "\n")
+		},
+		// Template function name: jsonFile
+		// Description: jsonParse applied to the contents of the file at path.
+		//
+		// Usage: jsonFile path key1::key2::key3::keyN
+		//
+		// Example: jsonFile "/etc/host-metadata/instance.json" "placement::zone"
+		// {
+		//     "placement": {
+		//         "zone": "eu-west-1a"
+		//     }
+		// }
+		// Output: "eu-west-1a"
+		//
+		"jsonFile": func(path, k string) string {
+			return jsonParse(b.sources["jsonFile"].Get(path), k)
+		},
+		// Template function name: jsonParse
+		// Description: Extract value from JSON object by specifying exact path (nested objects). Keys in path has to be separated with double colon sign.
+		//
+		// Usage: jsonParse b key1::key2::key3::keyN
+		//
+		// Example: jsonParse b "Additional::Country"
+		// {
+		//     "Additional": {
+		//         "Country": "United States"
+		//     }
+		// }
+		// Output: "United States"
+		//
+		"jsonParse": jsonParse,
+	}
+}
+
+func jsonParse(b []byte, k string) string {
+	var (
+		keys []string
+		js   []byte
+		err  error
+	)
+
+	keys = strings.Split(k, "::")
+
+	js, _, _, err = jsonp.Get(b, keys...)
+	if err != nil {
+		log.Printf("jsonParse template function encountered an error while parsing JSON object %v: %v", keys, err)
+	}
+
+	return string(js)
+}
@@ -3,6 +3,7 @@ package bridge
 
 import (
 	"net/url"
+	"time"
 
 	dockerapi "github.com/fsouza/go-dockerclient"
 )
@@ -17,18 +18,37 @@ type RegistryAdapter interface {
 	Deregister(service *Service) error
 	Refresh(service *Service) error
 	Services() ([]*Service, error)
+	// UpdateStatus writes the availability of a registered service after
+	// one of its StatusAttrs changed, see Service.Status
+	UpdateStatus(service *Service) error
 }
 
 type Config struct {
-	HostIp          string
-	Internal        bool
-	Explicit        bool
-	UseIpFromLabel  string
-	ForceTags       string
-	RefreshTtl      int
-	RefreshInterval int
-	DeregisterCheck string
-	Cleanup         bool
+	HostIp            string
+	NodeID            string
+	Internal          bool
+	Explicit          bool
+	UseIpFromLabel    string
+	ForceTags         string
+	RefreshTtl        int
+	RefreshInterval   int
+	DeregisterCheck   string
+	Cleanup           bool
+	CleanupDryRun     bool
+	CleanupMax        string
+	CleanupLegacy     bool
+	ConflictPolicy    string
+	MetadataPrefixes  []string
+	DiscoverHostPorts bool
+	ProcPath          string
+	DrainPeriod       int
+	FlapThreshold     int
+	FlapWindow        int
+
+	TemplateCacheTtl       int
+	TemplateCacheStale     int
+	TemplateTimeout        int
+	TemplateSourceTimeouts map[string]int
 }
 
 type Service struct {
@@ -40,14 +60,57 @@ type Service struct {
 	Attrs map[string]string
 	TTL   int
 
+	// Ports holds the named ports of a service registered for several
+	// ports of a container at once, see SERVICE_PRIMARY_PORT
+	Ports map[string]NamedPort
+
 	Origin ServicePort
+
+	// Owner is the Registrator that registered the service, if known
+	Owner *Owner
+
+	history         []Transition
+	nextRefresh     time.Time
+	refreshFailures int
+
+	// requestedID is the ID before a suffix was appended to resolve a
+	// conflict, conflict the last conflict it ran into, and displaced is set
+	// while another service holds its ID or endpoint
+	requestedID string
+	conflict    string
+	displaced   bool
 }
 
+// StatusAttrs are the attributes that take a service out of rotation while
+// they are set, in order of precedence.
+var StatusAttrs = []string{"maintenance", "failing", "draining", "unhealthy"}
+
+// Status returns the first of StatusAttrs set on the service, or "" when it
+// is available.
+func (s *Service) Status() string {
+	for _, attr := range StatusAttrs {
+		if s.Attrs[attr] != "" {
+			return attr
+		}
+	}
+	return ""
+}
+
+// DeadContainer held the services of an exited container until their TTL
+// expired.
+//
+// Deprecated: the bridge no longer uses it, services of exited containers are
+// tracked in the dead or failed state instead.
 type DeadContainer struct {
 	TTL      int
 	Services []*Service
 }
 
+type NamedPort struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
 type ServicePort struct {
 	HostPort          string
 	HostIP            string
@@ -58,4 +121,10 @@ type ServicePort struct {
 	ContainerID       string
 	ContainerName     string
 	container         *dockerapi.Container
+
+	// IP and Port are the endpoint derived from the port binding, which
+	// differs from Service.IP and Service.Port when SERVICE_ADDRESS or
+	// SERVICE_PORT override the advertised endpoint
+	IP   string
+	Port int
 }
@@ -1,6 +1,11 @@
 package bridge
 
-import "net/url"
+import (
+	"net/url"
+	"sync"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
 
 type fakeFactory struct{}
 
@@ -26,3 +31,76 @@ func (f *fakeAdapter) Refresh(service *Service) error {
 func (f *fakeAdapter) Services() ([]*Service, error) {
 	return nil, nil
 }
+func (f *fakeAdapter) UpdateStatus(service *Service) error {
+	return nil
+}
+
+// recordingAdapter remembers the calls made to it, as "<method> <service-id>",
+// and lists the services in registered. Registrations and refreshes fail with
+// registerErr and refreshErr when they are set.
+type recordingAdapter struct {
+	fakeAdapter
+	mu          sync.Mutex
+	calls       []string
+	registered  []*Service
+	registerErr error
+	refreshErr  error
+}
+
+func (r *recordingAdapter) record(method string, service *Service) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, method+" "+service.ID)
+	return nil
+}
+func (r *recordingAdapter) Register(service *Service) error {
+	r.record("register", service)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.registerErr
+}
+func (r *recordingAdapter) Refresh(service *Service) error {
+	r.record("refresh", service)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refreshErr
+}
+func (r *recordingAdapter) Deregister(service *Service) error {
+	return r.record("deregister", service)
+}
+func (r *recordingAdapter) UpdateStatus(service *Service) error {
+	return r.record("status:"+service.Status(), service)
+}
+func (r *recordingAdapter) Services() ([]*Service, error) {
+	return r.registered, nil
+}
+func (r *recordingAdapter) Calls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.calls...)
+}
+
+// fakeDocker serves a fixed set of containers.
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers map[string]*dockerapi.Container
+}
+
+func (d *fakeDocker) InspectContainer(id string) (*dockerapi.Container, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	container, ok := d.containers[id]
+	if !ok {
+		return nil, &dockerapi.NoSuchContainer{ID: id}
+	}
+	return container, nil
+}
+func (d *fakeDocker) ListContainers(opts dockerapi.ListContainersOptions) ([]dockerapi.APIContainers, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var listing []dockerapi.APIContainers
+	for id := range d.containers {
+		listing = append(listing, dockerapi.APIContainers{ID: id})
+	}
+	return listing, nil
+}
@@ -1,6 +1,8 @@
 package bridge
 
 import (
+	"log"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -54,36 +56,148 @@ func combineTags(tagParts ...string) []string {
 	return tags
 }
 
-func serviceMetaData(config *dockerapi.Config, port string) (map[string]string, map[string]bool) {
-	meta := config.Env
+// DefaultMetadataPrefix is the prefix of container metadata keys used when no
+// other prefix is configured.
+const DefaultMetadataPrefix = "SERVICE_"
+
+// knownPortTypes are the protocols a port can be published with.
+var knownPortTypes = map[string]bool{"tcp": true, "udp": true, "sctp": true}
+
+// serviceMetaData collects the metadata for port ("80" or "53/udp") from
+// environment variables and labels starting with one of prefixes. Keys may be
+// general (SERVICE_NAME), port-specific (SERVICE_53_NAME) or protocol-specific
+// (SERVICE_53_UDP_NAME). A prefix ending with a dot is a reverse-DNS namespace
+// (com.acme.discovery.8080.check.http), whose remaining dots are read as
+// underscores. When a key is set more than once, a protocol-specific value
+// beats a port-specific one, which beats a general one, then earlier prefixes
+// beat later ones, then labels beat environment variables.
+func serviceMetaData(config *dockerapi.Config, port string, prefixes []string) (map[string]string, map[string]bool) {
+	if len(prefixes) == 0 {
+		prefixes = []string{DefaultMetadataPrefix}
+	}
+	portType := "tcp"
+	if parts := strings.SplitN(port, "/", 2); len(parts) == 2 {
+		port, portType = parts[0], parts[1]
+	}
+
+	type source struct {
+		kv    string
+		label bool
+	}
+	meta := make([]source, 0, len(config.Env)+len(config.Labels))
+	for _, kv := range config.Env {
+		meta = append(meta, source{kv, false})
+	}
 	for k, v := range config.Labels {
-		meta = append(meta, k+"="+v)
+		meta = append(meta, source{k + "=" + v, true})
 	}
+
 	metadata := make(map[string]string)
 	metadataFromPort := make(map[string]bool)
-	for _, kv := range meta {
-		kvp := strings.SplitN(kv, "=", 2)
-		if strings.HasPrefix(kvp[0], "SERVICE_") && len(kvp) > 1 {
-			key := strings.ToLower(strings.TrimPrefix(kvp[0], "SERVICE_"))
-			if metadataFromPort[key] {
+	ranks := make(map[string][3]int)
+	for _, m := range meta {
+		kvp := strings.SplitN(m.kv, "=", 2)
+		if len(kvp) < 2 {
+			continue
+		}
+		for i, prefix := range prefixes {
+			if !strings.HasPrefix(kvp[0], prefix) {
 				continue
 			}
+			key := strings.ToLower(strings.TrimPrefix(kvp[0], prefix))
+			if strings.HasSuffix(prefix, ".") {
+				key = strings.Replace(key, ".", "_", -1)
+			}
+			specificity := 2
 			portkey := strings.SplitN(key, "_", 2)
 			_, err := strconv.Atoi(portkey[0])
 			if err == nil && len(portkey) > 1 {
 				if portkey[0] != port {
-					continue
+					break
 				}
-				metadata[portkey[1]] = kvp[1]
-				metadataFromPort[portkey[1]] = true
-			} else {
-				metadata[key] = kvp[1]
+				key = portkey[1]
+				specificity = 1
+				protokey := strings.SplitN(key, "_", 2)
+				if knownPortTypes[protokey[0]] && len(protokey) > 1 {
+					if protokey[0] != portType {
+						break
+					}
+					key = protokey[1]
+					specificity = 0
+				}
+			}
+			if key == "" {
+				break
 			}
+
+			rank := [3]int{specificity, i, 1}
+			if m.label {
+				rank[2] = 0
+			}
+			if best, ok := ranks[key]; ok && lessRank(best, rank) {
+				break
+			}
+			ranks[key] = rank
+			metadata[key] = kvp[1]
+			metadataFromPort[key] = specificity < 2
+			break
 		}
 	}
 	return metadata, metadataFromPort
 }
 
+// lessRank reports whether rank a takes precedence over rank b.
+func lessRank(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+type serviceAlias struct {
+	name string
+	tags string
+}
+
+// serviceAliases removes the alias metadata from metadata and returns the
+// aliases it declares: the comma-separated names in "aliases", each with
+// optional tags in "alias_<name>_tags".
+func serviceAliases(metadata map[string]string) []serviceAlias {
+	var aliases []serviceAlias
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(metadata["aliases"], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		if !aliasPattern.MatchString(name) {
+			log.Printf("ignored alias %q: only letters, digits, '_', '.' and '-' are allowed", name)
+			continue
+		}
+		if knownPortTypes[strings.ToLower(name)] {
+			// <node>:<name>:80:udp would read as the UDP service of port 80
+			log.Printf("ignored alias %q: protocol names can't be aliases", name)
+			continue
+		}
+		aliases = append(aliases, serviceAlias{
+			name: name,
+			tags: metadata["alias_"+strings.ToLower(name)+"_tags"],
+		})
+	}
+	delete(metadata, "aliases")
+	for key := range metadata {
+		if strings.HasPrefix(key, "alias_") && strings.HasSuffix(key, "_tags") {
+			delete(metadata, key)
+		}
+	}
+	return aliases
+}
+
+var aliasPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
 func servicePort(container *dockerapi.Container, port dockerapi.Port, published []dockerapi.PortBinding) ServicePort {
 	var hp, hip, ep, ept, eip, nm string
 	if len(published) > 0 {
@@ -129,3 +243,50 @@ func servicePort(container *dockerapi.Container, port dockerapi.Port, published
 		container:         container,
 	}
 }
+
+// sameService reports whether the registered ext has the endpoint, name and
+// tags of service. Attributes are only compared when the backend reports them.
+func sameService(service, ext *Service) bool {
+	if service.Name != ext.Name || service.IP != ext.IP || service.Port != ext.Port {
+		return false
+	}
+	if !sameStrings(service.Tags, ext.Tags) {
+		return false
+	}
+	if ext.Attrs == nil {
+		return true
+	}
+	if len(service.Attrs) != len(ext.Attrs) {
+		return false
+	}
+	for k, v := range service.Attrs {
+		if w, ok := ext.Attrs[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func samePorts(a, b map[string]NamedPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, port := range a {
+		if other, ok := b[name]; !ok || port != other {
+			return false
+		}
+	}
+	return true
+}
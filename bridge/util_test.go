@@ -4,6 +4,7 @@ import (
 	"sort"
 	"testing"
 
+	dockerapi "github.com/fsouza/go-dockerclient"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -57,3 +58,57 @@ func TestEscapedComma(t *testing.T) {
 		assert.EqualValues(t, c.Expected, results)
 	}
 }
+
+func TestServiceMetaData(t *testing.T) {
+	config := &dockerapi.Config{
+		Env: []string{
+			"SERVICE_NAME=env-name",
+			"SERVICE_TAGS=env-tags",
+			"SERVICE_80_CHECK_HTTP=/env",
+			"SERVICE_443_NAME=other-port",
+			"HOME=/root",
+		},
+		Labels: map[string]string{
+			"SERVICE_NAME":                     "label-name",
+			"com.acme.discovery.name":          "acme-name",
+			"com.acme.discovery.80.check.http": "/acme",
+			"com.acme.discovery.region":        "eu",
+		},
+	}
+
+	metadata, fromPort := serviceMetaData(config, "80", nil)
+	assert.Equal(t, map[string]string{
+		"name":       "label-name",
+		"tags":       "env-tags",
+		"check_http": "/env",
+	}, metadata)
+	assert.True(t, fromPort["check_http"])
+	assert.False(t, fromPort["name"])
+
+	metadata, _ = serviceMetaData(config, "80", []string{"com.acme.discovery.", "SERVICE_"})
+	assert.Equal(t, map[string]string{
+		"name":       "acme-name",
+		"tags":       "env-tags",
+		"check_http": "/acme",
+		"region":     "eu",
+	}, metadata)
+
+	metadata, fromPort = serviceMetaData(config, "443", []string{"com.acme.discovery.", "SERVICE_"})
+	assert.Equal(t, "other-port", metadata["name"])
+	assert.True(t, fromPort["name"])
+}
+
+func TestServiceAliases(t *testing.T) {
+	metadata := map[string]string{
+		"aliases":           "legacy-api, v2-api,,legacy-api,bad:name,udp,SCTP",
+		"alias_v2-api_tags": "v2,beta",
+		"region":            "eu",
+	}
+
+	aliases := serviceAliases(metadata)
+	assert.Equal(t, []serviceAlias{
+		{name: "legacy-api"},
+		{name: "v2-api", tags: "v2,beta"},
+	}, aliases)
+	assert.Equal(t, map[string]string{"region": "eu"}, metadata)
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -23,11 +24,21 @@ func init() {
 }
 
 func (r *ConsulAdapter) interpolateService(script string, service *bridge.Service) string {
-	withIp := strings.Replace(script, "$SERVICE_IP", service.IP, -1)
-	withPort := strings.Replace(withIp, "$SERVICE_PORT", strconv.Itoa(service.Port), -1)
+	ip, port := checkEndpoint(service)
+	withIp := strings.Replace(script, "$SERVICE_IP", ip, -1)
+	withPort := strings.Replace(withIp, "$SERVICE_PORT", strconv.Itoa(port), -1)
 	return withPort
 }
 
+// checkEndpoint returns the address health checks target: the port binding of
+// the container, even when SERVICE_ADDRESS or SERVICE_PORT advertise another.
+func checkEndpoint(service *bridge.Service) (string, int) {
+	if service.Origin.IP == "" {
+		return service.IP, service.Port
+	}
+	return service.Origin.IP, service.Origin.Port
+}
+
 type Factory struct{}
 
 func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
@@ -85,17 +96,69 @@ func (r *ConsulAdapter) Register(service *bridge.Service) error {
 	registration.Tags = service.Tags
 	registration.Address = service.IP
 	registration.Check = r.buildCheck(service)
-	registration.Meta = service.Attrs
+	registration.Meta = r.buildMeta(service)
 	return r.client.Agent().ServiceRegister(registration)
 }
 
+// portsMeta lists the named ports written by buildMeta, so that they can be
+// told apart from attributes that happen to start with "port_".
+const portsMeta = "registrator_ports"
+
+// buildMeta returns the service attributes along with a "port_<name>" entry
+// for every named port, and the owner of the service.
+func (r *ConsulAdapter) buildMeta(service *bridge.Service) map[string]string {
+	if len(service.Ports) == 0 && service.Owner == nil {
+		return service.Attrs
+	}
+	meta := make(map[string]string, len(service.Attrs)+len(service.Ports)+4)
+	for k, v := range service.Attrs {
+		meta[k] = v
+	}
+	if len(service.Ports) > 0 {
+		names := make([]string, 0, len(service.Ports))
+		for name, port := range service.Ports {
+			meta["port_"+name] = strconv.Itoa(port.Port)
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		meta[portsMeta] = strings.Join(names, ",")
+	}
+	if service.Owner != nil {
+		for k, v := range service.Owner.Meta() {
+			meta[k] = v
+		}
+	}
+	return meta
+}
+
+// serviceAttrs returns the service attributes in the metadata written by
+// buildMeta, without the named ports and the owner, so that resync can
+// compare them.
+func serviceAttrs(meta map[string]string) map[string]string {
+	attrs := make(map[string]string, len(meta))
+	for k, v := range meta {
+		attrs[k] = v
+	}
+	if ports := meta[portsMeta]; ports != "" {
+		for _, name := range strings.Split(ports, ",") {
+			delete(attrs, "port_"+name)
+		}
+	}
+	delete(attrs, portsMeta)
+	delete(attrs, bridge.OwnerNodeMeta)
+	delete(attrs, bridge.OwnerContainerMeta)
+	delete(attrs, bridge.OwnerInstanceMeta)
+	return attrs
+}
+
 func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServiceCheck {
 	check := new(consulapi.AgentServiceCheck)
+	ip, port := checkEndpoint(service)
 	if status := service.Attrs["check_initial_status"]; status != "" {
 		check.Status = status
 	}
 	if path := service.Attrs["check_http"]; path != "" {
-		check.HTTP = fmt.Sprintf("http://%s:%d%s", service.IP, service.Port, path)
+		check.HTTP = fmt.Sprintf("http://%s:%d%s", ip, port, path)
 		if timeout := service.Attrs["check_timeout"]; timeout != "" {
 			check.Timeout = timeout
 		}
@@ -103,7 +166,7 @@ func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServ
 			check.Method = method
 		}
 	} else if path := service.Attrs["check_https"]; path != "" {
-		check.HTTP = fmt.Sprintf("https://%s:%d%s", service.IP, service.Port, path)
+		check.HTTP = fmt.Sprintf("https://%s:%d%s", ip, port, path)
 		if timeout := service.Attrs["check_timeout"]; timeout != "" {
 			check.Timeout = timeout
 		}
@@ -116,13 +179,16 @@ func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServ
 		check.Args = []string{r.interpolateService(script, service)}
 	} else if ttl := service.Attrs["check_ttl"]; ttl != "" {
 		check.TTL = ttl
+		if status := checkStatus(service); status != "" && check.Status == "" {
+			check.Status = status
+		}
 	} else if tcp := service.Attrs["check_tcp"]; tcp != "" {
-		check.TCP = fmt.Sprintf("%s:%d", service.IP, service.Port)
+		check.TCP = fmt.Sprintf("%s:%d", ip, port)
 		if timeout := service.Attrs["check_timeout"]; timeout != "" {
 			check.Timeout = timeout
 		}
 	} else if grpc := service.Attrs["check_grpc"]; grpc != "" {
-		check.GRPC = fmt.Sprintf("%s:%d", service.IP, service.Port)
+		check.GRPC = fmt.Sprintf("%s:%d", ip, port)
 		if timeout := service.Attrs["check_timeout"]; timeout != "" {
 			check.Timeout = timeout
 		}
@@ -152,24 +218,97 @@ func (r *ConsulAdapter) Deregister(service *bridge.Service) error {
 	return r.client.Agent().ServiceDeregister(service.ID)
 }
 
+// Refresh passes or fails the TTL check of a service of a container with a
+// Docker health check per its health, which keeps the check from expiring.
 func (r *ConsulAdapter) Refresh(service *bridge.Service) error {
-	return nil
+	return r.updateTTL(service)
+}
+
+// checkStatus returns the Consul check status matching the Docker health of
+// the container of a service, or "" without a Docker health check.
+func checkStatus(service *bridge.Service) string {
+	switch service.Attrs[bridge.HealthAttr] {
+	case bridge.HealthHealthy:
+		return consulapi.HealthPassing
+	case bridge.HealthStarting:
+		return consulapi.HealthWarning
+	case bridge.HealthUnhealthy:
+		return consulapi.HealthCritical
+	}
+	return ""
+}
+
+// healthTTL reports whether the TTL check of a service follows the Docker
+// health of its container.
+func healthTTL(service *bridge.Service) bool {
+	return service.Attrs["check_ttl"] != "" && checkStatus(service) != ""
+}
+
+// updateTTL updates the TTL check of a service with the Docker health of its
+// container, through the check update API of the agent.
+func (r *ConsulAdapter) updateTTL(service *bridge.Service) error {
+	if !healthTTL(service) {
+		return nil
+	}
+	output := "docker health: " + service.Attrs[bridge.HealthAttr]
+	if detail := service.Attrs["unhealthy"]; detail != "" && detail != "true" {
+		output += ": " + detail
+	}
+	return r.client.Agent().UpdateTTL("service:"+service.ID, output, checkStatus(service))
+}
+
+// UpdateStatus updates the service metadata, and puts the service in
+// maintenance mode while it is unavailable, so that it fails health checks.
+// An unhealthy service with a TTL check that follows the Docker health fails
+// that check instead.
+func (r *ConsulAdapter) UpdateStatus(service *bridge.Service) error {
+	if err := r.Register(service); err != nil {
+		return err
+	}
+	if err := r.updateTTL(service); err != nil {
+		return err
+	}
+	status := service.Status()
+	if status == "unhealthy" && healthTTL(service) {
+		status = ""
+	}
+	if status != "" {
+		reason := "registrator: " + status
+		if detail := service.Attrs[status]; detail != "true" {
+			reason += ": " + detail
+		}
+		return r.client.Agent().EnableServiceMaintenance(service.ID, reason)
+	}
+	return r.client.Agent().DisableServiceMaintenance(service.ID)
+}
+
+// agentService is a service of the local agent as listed by
+// /v1/agent/services, which includes the metadata api.AgentService lacks.
+type agentService struct {
+	ID      string
+	Service string
+	Tags    []string
+	Port    int
+	Address string
+	Meta    map[string]string
 }
 
 func (r *ConsulAdapter) Services() ([]*bridge.Service, error) {
-	services, err := r.client.Agent().Services()
-	if err != nil {
+	var services map[string]*agentService
+	if _, err := r.client.Raw().Query("/v1/agent/services", &services, nil); err != nil {
 		return []*bridge.Service{}, err
 	}
 	out := make([]*bridge.Service, len(services))
 	i := 0
 	for _, v := range services {
 		s := &bridge.Service{
-			ID:   v.ID,
-			Name: v.Service,
-			Port: v.Port,
-			Tags: v.Tags,
-			IP:   v.Address,
+			ID:    v.ID,
+			Name:  v.Service,
+			Port:  v.Port,
+			Tags:  v.Tags,
+			IP:    v.Address,
+			Attrs: serviceAttrs(v.Meta),
+			Owner: bridge.OwnerFromMeta(v.Meta),
 		}
 		out[i] = s
 		i++
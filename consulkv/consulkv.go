@@ -2,9 +2,7 @@ package consul
 
 import (
 	"log"
-	"net"
 	"net/url"
-	"strconv"
 	"strings"
 
 	"github.com/gliderlabs/registrator/bridge"
@@ -28,16 +26,21 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	} else if uri.Host != "" {
 		config.Address = uri.Host
 	}
+	format, err := bridge.ParseRecordFormat(uri.Query().Get("format"))
+	if err != nil {
+		log.Fatal("consulkv: ", err)
+	}
 	client, err := consulapi.NewClient(config)
 	if err != nil {
 		log.Fatal("consulkv: ", uri.Scheme)
 	}
-	return &ConsulKVAdapter{client: client, path: path}
+	return &ConsulKVAdapter{client: client, path: path, format: format}
 }
 
 type ConsulKVAdapter struct {
 	client *consulapi.Client
 	path   string
+	format bridge.RecordFormat
 }
 
 // Ping will try to connect to consul by attempting to retrieve the current leader.
@@ -53,12 +56,18 @@ func (r *ConsulKVAdapter) Ping() error {
 }
 
 func (r *ConsulKVAdapter) Register(service *bridge.Service) error {
+	if r.format.Hides(service) {
+		return nil
+	}
 	log.Println("Register")
 	path := r.path[1:] + "/" + service.Name + "/" + service.ID
-	port := strconv.Itoa(service.Port)
-	addr := net.JoinHostPort(service.IP, port)
+	value, err := r.format.Encode(service)
+	if err != nil {
+		log.Println("consulkv: failed to encode service:", err)
+		return err
+	}
 	log.Printf("path: %s", path)
-	_, err := r.client.KV().Put(&consulapi.KVPair{Key: path, Value: []byte(addr)}, nil)
+	_, err = r.client.KV().Put(&consulapi.KVPair{Key: path, Value: value}, nil)
 	if err != nil {
 		log.Println("consulkv: failed to register service:", err)
 	}
@@ -78,6 +87,26 @@ func (r *ConsulKVAdapter) Refresh(service *bridge.Service) error {
 	return nil
 }
 
+// Services lists the services stored as JSON records. Plain entries don't
+// say which service they are.
 func (r *ConsulKVAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+	if r.format != bridge.RecordJSON {
+		return []*bridge.Service{}, nil
+	}
+	pairs, _, err := r.client.KV().List(r.path[1:]+"/", nil)
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	values := make([][]byte, len(pairs))
+	for i, pair := range pairs {
+		values[i] = pair.Value
+	}
+	return bridge.DecodeRecords(values), nil
+}
+
+func (r *ConsulKVAdapter) UpdateStatus(service *bridge.Service) error {
+	if r.format.Hides(service) {
+		return r.Deregister(service)
+	}
+	return r.Register(service)
 }
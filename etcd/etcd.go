@@ -3,17 +3,18 @@ package etcd
 import (
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"regexp"
-	"strconv"
 
 	etcd2 "github.com/coreos/go-etcd/etcd"
 	"github.com/gliderlabs/registrator/bridge"
 	etcd "gopkg.in/coreos/go-etcd.v0/etcd"
 )
 
+// keyNotFound is the etcd error code for a missing key.
+const keyNotFound = 100
+
 func init() {
 	bridge.Register(new(Factory), "etcd")
 }
@@ -36,19 +37,25 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	defer res.Body.Close()
 	body, _ := ioutil.ReadAll(res.Body)
 
+	format, err := bridge.ParseRecordFormat(uri.Query().Get("format"))
+	if err != nil {
+		log.Fatal("etcd: ", err)
+	}
+
 	if match, _ := regexp.Match("0\\.4\\.*", body); match == true {
 		log.Println("etcd: using v0 client")
-		return &EtcdAdapter{client: etcd.NewClient(urls), path: uri.Path}
+		return &EtcdAdapter{client: etcd.NewClient(urls), path: uri.Path, format: format}
 	}
 
-	return &EtcdAdapter{client2: etcd2.NewClient(urls), path: uri.Path}
+	return &EtcdAdapter{client2: etcd2.NewClient(urls), path: uri.Path, format: format}
 }
 
 type EtcdAdapter struct {
 	client  *etcd.Client
 	client2 *etcd2.Client
 
-	path string
+	path   string
+	format bridge.RecordFormat
 }
 
 func (r *EtcdAdapter) Ping() error {
@@ -83,17 +90,22 @@ func (r *EtcdAdapter) syncEtcdCluster() {
 }
 
 func (r *EtcdAdapter) Register(service *bridge.Service) error {
+	if r.format.Hides(service) {
+		return nil
+	}
 	r.syncEtcdCluster()
 
 	path := r.path + "/" + service.Name + "/" + service.ID
-	port := strconv.Itoa(service.Port)
-	addr := net.JoinHostPort(service.IP, port)
+	value, err := r.format.Encode(service)
+	if err != nil {
+		log.Println("etcd: failed to encode service:", err)
+		return err
+	}
 
-	var err error
 	if r.client != nil {
-		_, err = r.client.Set(path, addr, uint64(service.TTL))
+		_, err = r.client.Set(path, string(value), uint64(service.TTL))
 	} else {
-		_, err = r.client2.Set(path, addr, uint64(service.TTL))
+		_, err = r.client2.Set(path, string(value), uint64(service.TTL))
 	}
 
 	if err != nil {
@@ -124,6 +136,47 @@ func (r *EtcdAdapter) Refresh(service *bridge.Service) error {
 	return r.Register(service)
 }
 
+// Services lists the services stored as JSON records. Plain entries don't
+// say which service they are.
 func (r *EtcdAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+	if r.format != bridge.RecordJSON {
+		return []*bridge.Service{}, nil
+	}
+	r.syncEtcdCluster()
+
+	// services are stored at <path>/<name>/<id>
+	var values [][]byte
+	if r.client != nil {
+		res, err := r.client.Get(r.path, false, true)
+		if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == keyNotFound {
+			return []*bridge.Service{}, nil
+		} else if err != nil {
+			return []*bridge.Service{}, err
+		}
+		for _, name := range res.Node.Nodes {
+			for _, node := range name.Nodes {
+				values = append(values, []byte(node.Value))
+			}
+		}
+	} else {
+		res, err := r.client2.Get(r.path, false, true)
+		if etcdErr, ok := err.(*etcd2.EtcdError); ok && etcdErr.ErrorCode == keyNotFound {
+			return []*bridge.Service{}, nil
+		} else if err != nil {
+			return []*bridge.Service{}, err
+		}
+		for _, name := range res.Node.Nodes {
+			for _, node := range name.Nodes {
+				values = append(values, []byte(node.Value))
+			}
+		}
+	}
+	return bridge.DecodeRecords(values), nil
+}
+
+func (r *EtcdAdapter) UpdateStatus(service *bridge.Service) error {
+	if r.format.Hides(service) {
+		return r.Deregister(service)
+	}
+	return r.Register(service)
 }
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gliderlabs/registrator/bridge"
+)
+
+// handleMaintenanceSignals turns host maintenance on with SIGUSR1, and off
+// with SIGUSR2.
+func handleMaintenanceSignals(b *bridge.Bridge) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			log.Println("received", sig)
+			b.SetHostMaintenance(sig == syscall.SIGUSR1, "")
+		}
+	}()
+}
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/gliderlabs/registrator/bridge"
+
+// handleMaintenanceSignals does nothing, Windows has no SIGUSR1 and SIGUSR2.
+// Use -control-addr instead.
+func handleMaintenanceSignals(b *bridge.Bridge) {}
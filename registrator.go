@@ -5,8 +5,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,10 +29,29 @@ var refreshInterval = flag.Int("ttl-refresh", 0, "Frequency with which service T
 var refreshTtl = flag.Int("ttl", 0, "TTL for services (default is no expiry)")
 var forceTags = flag.String("tags", "", "Append tags for all registered services (supports Go template)")
 var resyncInterval = flag.Int("resync", 0, "Frequency with which services are resynchronized")
-var deregister = flag.String("deregister", "always", "Deregister exited services \"always\" or \"on-success\"")
+var deregister = flag.String("deregister", "always", "Deregister exited services \"always\", \"on-success\", or per a policy like \"restarting=keep,oom=fail,any=deregister\"")
 var retryAttempts = flag.Int("retry-attempts", 0, "Max retry attempts to establish a connection with the backend. Use -1 for infinite retries")
 var retryInterval = flag.Int("retry-interval", 2000, "Interval (in millisecond) between retry-attempts.")
+var controlAddr = flag.String("control-addr", "", "Address of the local control endpoint, e.g. \"127.0.0.1:4567\" (disabled by default)")
 var cleanup = flag.Bool("cleanup", false, "Remove dangling services")
+var nodeID = flag.String("node-id", "", "Identity of this host in service IDs and ownership, or \"@docker-name\" or \"@docker-id\" for the Docker daemon's (default is the hostname)")
+var nodeIDFile = flag.String("node-id-file", "", "File the node ID is kept in across restarts, created if missing")
+var cleanupDryRun = flag.Bool("cleanup-dry-run", false, "Only log and report the dangling services -cleanup would remove")
+var cleanupLegacy = flag.Bool("cleanup-legacy", false, "Also remove dangling services without an owner whose ID starts with the node ID, as registered by older releases")
+var cleanupMax = flag.String("cleanup-max", "", "Max dangling services removed per resync, a number or a percentage of the services registered from this host (default no limit)")
+var conflictPolicy = flag.String("conflict-policy", bridge.ConflictLastWriterWins, "What to do with a service whose ID or IP and port another container or host registered: \"last-writer-wins\", \"reject\" or \"suffix\"")
+var flapThreshold = flag.Int("flap-threshold", 0, "Number of starts within -flap-window after which registration of a container is suppressed (0 disables flap dampening)")
+var flapWindow = flag.Int("flap-window", 60, "Seconds in which -flap-threshold starts make a container flapping, and it has to stay up to be registered again")
+var eventWindow = flag.Int("event-window", 0, "Interval (in millisecond) Docker events are collected for and handled as a batch (0 handles them right away)")
+var drainPeriod = flag.Int("drain", 0, "Seconds services of a stopping container are marked unavailable before they are deregistered")
+var discoverHostPorts = flag.Bool("discover-host-ports", false, "Discover listening ports of host network containers from /proc")
+var discoverInterval = flag.Int("discover-interval", 30, "Frequency with which listening ports of host network containers are rediscovered")
+var procPath = flag.String("proc-path", "/proc", "Path the host /proc is mounted at, for -discover-host-ports")
+var metadataPrefix = flag.String("metadata-prefix", bridge.DefaultMetadataPrefix, "Comma-separated prefixes of labels and environment variables holding service metadata, in order of precedence")
+var templateCacheTtl = flag.Int("template-cache-ttl", 60, "Seconds template data source results (httpGet, fileRead, ...) are cached, 0 to disable caching")
+var templateCacheStale = flag.Int("template-cache-stale", 300, "Seconds an expired template data source result is still served while it is refreshed")
+var templateTimeout = flag.Int("template-timeout", 2000, "Timeout (in millisecond) for template data source lookups")
+var templateSourceTimeouts = flag.String("template-source-timeouts", "", "Per data source timeouts (in millisecond), e.g. \"httpGet=5000,dnsLookup=500\"")
 
 func getopt(name, def string) string {
 	if env := os.Getenv(name); env != "" {
@@ -39,6 +60,36 @@ func getopt(name, def string) string {
 	return def
 }
 
+// parseSourceTimeouts parses a comma-separated list of name=milliseconds pairs.
+func parseSourceTimeouts(s string) (map[string]int, error) {
+	sources := bridge.TemplateSources()
+	known := make(map[string]bool, len(sources))
+	for _, name := range sources {
+		known[name] = true
+	}
+	timeouts := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("-template-source-timeouts: expected name=milliseconds, got %q", pair)
+		}
+		ms, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("-template-source-timeouts: invalid timeout for %q", kv[0])
+		}
+		name := strings.TrimSpace(kv[0])
+		if !known[name] {
+			return nil, fmt.Errorf("-template-source-timeouts: unknown data source %q, expected one of %s",
+				name, strings.Join(sources, ", "))
+		}
+		timeouts[name] = ms
+	}
+	return timeouts, nil
+}
+
 func assert(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -82,10 +133,33 @@ func main() {
 		assert(errors.New("-ttl must be greater than -ttl-refresh"))
 	}
 
+	if *flapThreshold == 1 || *flapThreshold < 0 {
+		assert(errors.New("-flap-threshold must be 0 or at least 2"))
+	} else if *flapThreshold > 0 && *flapWindow <= 0 {
+		assert(errors.New("-flap-window must be greater than 0"))
+	}
+
+	if (*cleanup || *cleanupDryRun) && *resyncInterval == 0 {
+		log.Println("dangling services are only removed once two syncs saw them, -cleanup needs -resync to remove any")
+	}
+
 	if *retryInterval <= 0 {
 		assert(errors.New("-retry-interval must be greater than 0"))
 	}
 
+	sourceTimeouts, err := parseSourceTimeouts(*templateSourceTimeouts)
+	assert(err)
+
+	var metadataPrefixes []string
+	for _, prefix := range strings.Split(*metadataPrefix, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			metadataPrefixes = append(metadataPrefixes, prefix)
+		}
+	}
+	if len(metadataPrefixes) == 0 {
+		assert(errors.New("-metadata-prefix must not be empty"))
+	}
+
 	dockerHost := os.Getenv("DOCKER_HOST")
 	if dockerHost == "" {
 		if runtime.GOOS != "windows" {
@@ -98,20 +172,36 @@ func main() {
 	docker, err := dockerapi.NewClientFromEnv()
 	assert(err)
 
-	if *deregister != "always" && *deregister != "on-success" {
-		assert(errors.New("-deregister must be \"always\" or \"on-success\""))
-	}
+	node, err := bridge.ResolveNodeID(docker, *nodeID, *nodeIDFile)
+	assert(err)
+	log.Println("Using node ID", node)
 
 	b, err := bridge.New(docker, flag.Arg(0), bridge.Config{
-		HostIp:          *hostIp,
-		Internal:        *internal,
-		Explicit:        *explicit,
-		UseIpFromLabel:  *useIpFromLabel,
-		ForceTags:       *forceTags,
-		RefreshTtl:      *refreshTtl,
-		RefreshInterval: *refreshInterval,
-		DeregisterCheck: *deregister,
-		Cleanup:         *cleanup,
+		HostIp:            *hostIp,
+		NodeID:            node,
+		Internal:          *internal,
+		Explicit:          *explicit,
+		UseIpFromLabel:    *useIpFromLabel,
+		ForceTags:         *forceTags,
+		RefreshTtl:        *refreshTtl,
+		RefreshInterval:   *refreshInterval,
+		DeregisterCheck:   *deregister,
+		Cleanup:           *cleanup,
+		CleanupDryRun:     *cleanupDryRun,
+		CleanupMax:        *cleanupMax,
+		CleanupLegacy:     *cleanupLegacy,
+		ConflictPolicy:    *conflictPolicy,
+		MetadataPrefixes:  metadataPrefixes,
+		DiscoverHostPorts: *discoverHostPorts,
+		ProcPath:          *procPath,
+		DrainPeriod:       *drainPeriod,
+		FlapThreshold:     *flapThreshold,
+		FlapWindow:        *flapWindow,
+
+		TemplateCacheTtl:       *templateCacheTtl,
+		TemplateCacheStale:     *templateCacheStale,
+		TemplateTimeout:        *templateTimeout,
+		TemplateSourceTimeouts: sourceTimeouts,
 	})
 
 	assert(err)
@@ -140,34 +230,46 @@ func main() {
 
 	b.Sync(false)
 
+	handleMaintenanceSignals(b)
+	if *controlAddr != "" {
+		log.Println("Serving control endpoint on", *controlAddr)
+		go func() {
+			assert(http.ListenAndServe(*controlAddr, b.ControlHandler()))
+		}()
+	}
+
 	quit := make(chan struct{})
 
-	// Start the TTL refresh timer
-	if *refreshInterval > 0 {
-		ticker := time.NewTicker(time.Duration(*refreshInterval) * time.Second)
+	// Start the TTL refresh scheduler, also needed for services with their
+	// own SERVICE_TTL
+	go b.RefreshLoop(quit)
+
+	// Start the resync timer if enabled
+	if *resyncInterval > 0 {
+		resyncTicker := time.NewTicker(time.Duration(*resyncInterval) * time.Second)
 		go func() {
 			for {
 				select {
-				case <-ticker.C:
-					b.Refresh()
+				case <-resyncTicker.C:
+					b.Sync(true)
 				case <-quit:
-					ticker.Stop()
+					resyncTicker.Stop()
 					return
 				}
 			}
 		}()
 	}
 
-	// Start the resync timer if enabled
-	if *resyncInterval > 0 {
-		resyncTicker := time.NewTicker(time.Duration(*resyncInterval) * time.Second)
+	// Start the host port discovery timer if enabled
+	if *discoverHostPorts && *discoverInterval > 0 {
+		discoverTicker := time.NewTicker(time.Duration(*discoverInterval) * time.Second)
 		go func() {
 			for {
 				select {
-				case <-resyncTicker.C:
-					b.Sync(true)
+				case <-discoverTicker.C:
+					b.Rescan()
 				case <-quit:
-					resyncTicker.Stop()
+					discoverTicker.Stop()
 					return
 				}
 			}
@@ -175,14 +277,7 @@ func main() {
 	}
 
 	// Process Docker events
-	for msg := range events {
-		switch msg.Status {
-		case "start":
-			go b.Add(msg.ID)
-		case "die":
-			go b.RemoveOnExit(msg.ID)
-		}
-	}
+	b.HandleEvents(events, time.Duration(*eventWindow)*time.Millisecond)
 
 	close(quit)
 	log.Fatal("Docker event loop closed") // todo: reconnect?
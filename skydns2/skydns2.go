@@ -44,16 +44,31 @@ func (r *Skydns2Adapter) Ping() error {
 }
 
 func (r *Skydns2Adapter) Register(service *bridge.Service) error {
-	port := strconv.Itoa(service.Port)
-	record := `{"host":"` + service.IP + `","port":` + port + `}`
-	_, err := r.client.Set(r.servicePath(service), record, uint64(service.TTL))
+	if service.Status() != "" {
+		// unavailable services stay out of DNS until they are available again
+		return nil
+	}
+	_, err := r.client.Set(r.servicePath(service), record(service.IP, service.Port), uint64(service.TTL))
 	if err != nil {
 		log.Println("skydns2: failed to register service:", err)
+		return err
+	}
+	for name, port := range service.Ports {
+		_, err = r.client.Set(r.portPath(service, name, port), record(service.IP, port.Port), uint64(service.TTL))
+		if err != nil {
+			log.Println("skydns2: failed to register named port:", name, err)
+		}
 	}
 	return err
 }
 
 func (r *Skydns2Adapter) Deregister(service *bridge.Service) error {
+	for name, port := range service.Ports {
+		_, err := r.client.Delete(r.portPath(service, name, port), false)
+		if err != nil {
+			log.Println("skydns2: failed to deregister named port:", name, err)
+		}
+	}
 	_, err := r.client.Delete(r.servicePath(service), false)
 	if err != nil {
 		log.Println("skydns2: failed to register service:", err)
@@ -65,6 +80,15 @@ func (r *Skydns2Adapter) Refresh(service *bridge.Service) error {
 	return r.Register(service)
 }
 
+// UpdateStatus removes the records of an unavailable service, and restores
+// them once it is available again.
+func (r *Skydns2Adapter) UpdateStatus(service *bridge.Service) error {
+	if service.Status() != "" {
+		return r.Deregister(service)
+	}
+	return r.Register(service)
+}
+
 func (r *Skydns2Adapter) Services() ([]*bridge.Service, error) {
 	return []*bridge.Service{}, nil
 }
@@ -73,6 +97,16 @@ func (r *Skydns2Adapter) servicePath(service *bridge.Service) string {
 	return r.path + "/" + service.Name + "/" + service.ID
 }
 
+// portPath is where the record of a named port is stored, so that it can be
+// looked up as the SRV record _<name>._<protocol>.<service>.<domain>.
+func (r *Skydns2Adapter) portPath(service *bridge.Service, name string, port bridge.NamedPort) string {
+	return r.path + "/" + service.Name + "/_" + port.Protocol + "/_" + name + "/" + service.ID
+}
+
+func record(ip string, port int) string {
+	return `{"host":"` + ip + `","port":` + strconv.Itoa(port) + `}`
+}
+
 func domainPath(domain string) string {
 	components := strings.Split(domain, ".")
 	for i, j := 0, len(components)-1; i < j; i, j = i+1, j-1 {
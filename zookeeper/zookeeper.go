@@ -45,11 +45,12 @@ type ZnodeBody struct {
 	ContainerID string
 	Tags        []string
 	Attrs       map[string]string
+	Ports       map[string]bridge.NamedPort `json:",omitempty"`
+	Owner       *bridge.Owner               `json:",omitempty"`
+	Status      string                      `json:",omitempty"`
 }
 
 func (r *ZkAdapter) Register(service *bridge.Service) error {
-	privatePort, _ := strconv.Atoi(service.Origin.ExposedPort)
-	publicPortString := strconv.Itoa(service.Port)
 	acl := zk.WorldACL(zk.PermAll)
 	basePath := r.path + "/" + service.Name
 	if (r.path == "/") {
@@ -65,12 +66,11 @@ func (r *ZkAdapter) Register(service *bridge.Service) error {
 				log.Println("zookeeper: failed to create base service node at path '" + basePath + "': ", err)
 			}
 		} // create base path for the service name if it missing
-		zbody := &ZnodeBody{Name: service.Name, IP: service.IP, PublicPort: service.Port, PrivatePort: privatePort, Tags: service.Tags, Attrs: service.Attrs, ContainerID: service.Origin.ContainerHostname}
-		body, err := json.Marshal(zbody)
+		body, err := znodeBody(service)
 		if err != nil {
 			log.Println("zookeeper: failed to json encode service body: ", err)
 		} else {
-			path := basePath + "/" + service.IP + ":" + publicPortString
+			path := basePath + "/" + portNode(service)
 			_, err = r.client.Create(path, body, 1, acl)
 			if err != nil {
 				log.Println("zookeeper: failed to register service at path '" + path + "': ", err)
@@ -80,6 +80,29 @@ func (r *ZkAdapter) Register(service *bridge.Service) error {
 	return err
 }
 
+func znodeBody(service *bridge.Service) ([]byte, error) {
+	privatePort, _ := strconv.Atoi(service.Origin.ExposedPort)
+	zbody := &ZnodeBody{Name: service.Name, IP: service.IP, PublicPort: service.Port, PrivatePort: privatePort, Tags: service.Tags, Attrs: service.Attrs, Ports: service.Ports, Owner: service.Owner, Status: service.Status(), ContainerID: service.Origin.ContainerHostname}
+	return json.Marshal(zbody)
+}
+
+// UpdateStatus rewrites the znode body, whose Attrs carry the status.
+func (r *ZkAdapter) UpdateStatus(service *bridge.Service) error {
+	basePath := r.path + "/" + service.Name
+	if r.path == "/" {
+		basePath = r.path + service.Name
+	}
+	body, err := znodeBody(service)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Set(basePath+"/"+portNode(service), body, -1)
+	if err != nil {
+		log.Println("zookeeper: failed to update service status: ", err)
+	}
+	return err
+}
+
 func (r *ZkAdapter) Ping() error {
 	_, _, err := r.client.Exists("/")
 	if err != nil {
@@ -94,8 +117,7 @@ func (r *ZkAdapter) Deregister(service *bridge.Service) error {
 	if (r.path == "/") {
 		basePath = r.path + service.Name
 	}
-	publicPortString := strconv.Itoa(service.Port)	
-	servicePortPath := basePath + "/" + service.IP + ":" + publicPortString
+	servicePortPath := basePath + "/" + portNode(service)
 	// Delete the service-port znode
 	err := r.client.Delete(servicePortPath, -1) // -1 means latest version number
 	if err != nil {
@@ -113,6 +135,21 @@ func (r *ZkAdapter) Deregister(service *bridge.Service) error {
 	return err
 }
 
+// portNode names the znode of a service: <ip>:<port>, with the protocol
+// appended for anything but TCP so that TCP and UDP on the same port coexist.
+// Services without a port get the container ID appended instead, as several
+// of them share port 0 on the same IP.
+func portNode(service *bridge.Service) string {
+	node := service.IP + ":" + strconv.Itoa(service.Port)
+	if portType := service.Origin.PortType; portType != "" && portType != "tcp" {
+		node += ":" + portType
+	}
+	if containerID := service.Origin.ContainerID; service.Port == 0 && len(containerID) >= 12 {
+		node += ":" + containerID[:12]
+	}
+	return node
+}
+
 func (r *ZkAdapter) Refresh(service *bridge.Service) error {
 	return r.Register(service)
 }